@@ -0,0 +1,47 @@
+package databaseexperiment
+
+// WriteBatch collects Put and Delete operations that Database.Write applies
+// atomically: after a crash either all of them are recovered or none, and
+// readers never see only a part of them. The zero value is an empty batch.
+type WriteBatch struct {
+	rows []DBRow
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key string, value interface{}) {
+	b.rows = append(b.rows, DBRow{Key: key, Value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.rows = append(b.rows, DBRow{Key: key, Type: RecordTypeTombstone})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.rows)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.rows = b.rows[:0]
+}
+
+// Write applies every operation of batch with a single append to the current
+// segment. When a key appears more than once the last operation wins.
+func (db *Database) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	pmTotalWrites.Add(float64(batch.Len()))
+	rows := make([]DBRow, batch.Len())
+	copy(rows, batch.rows)
+	if err := db.writeRows(rows, true); err != nil {
+		db.opts.Logger.Printf("couldn't write batch of %d operations err is: %v\n", len(rows), err)
+		return err
+	}
+	db.checkCurrentSegmentSizeInBackground()
+	return nil
+}
@@ -0,0 +1,136 @@
+package databaseexperiment
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// A bloom file sits next to an immutable segment and holds a Bloom filter of
+// its keys, so a lookup can skip a segment that certainly doesn't have a key:
+//
+//	| magic (4) | version (1) | segment size (8) | hash count (4) | bits... | crc32 of everything before (4) |
+//
+// Like hint files, a bloom file for a different segment size is ignored.
+const (
+	bloomFileSuffix = ".bloom"
+	bloomMagic      = "BLOM"
+	bloomVersion    = 1
+
+	bloomFalsePositiveRate = 0.01
+)
+
+var (
+	errInvalidBloomFile = errors.New("invalid bloom file")
+)
+
+func bloomFilePath(segmentPath string) string {
+	return segmentPath + bloomFileSuffix
+}
+
+type bloomFilter struct {
+	bits      []byte
+	hashCount uint32
+}
+
+// newBloomFilter sizes a filter for keyCount keys at bloomFalsePositiveRate.
+func newBloomFilter(keyCount int) *bloomFilter {
+	if keyCount < 1 {
+		keyCount = 1
+	}
+	bitCount := math.Ceil(-float64(keyCount) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashCount := math.Round(bitCount / float64(keyCount) * math.Ln2)
+	return &bloomFilter{
+		bits:      make([]byte, (int(bitCount)+7)/8),
+		hashCount: uint32(math.Max(hashCount, 1)),
+	}
+}
+
+// locations derives the bit positions of key by double hashing a single
+// 64 bit FNV-1a hash.
+func (f *bloomFilter) locations(key string, fn func(bit uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32
+	bitCount := uint64(len(f.bits)) * 8
+	for i := uint64(0); i < uint64(f.hashCount); i++ {
+		if !fn((h1 + i*h2) % bitCount) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) Add(key string) {
+	f.locations(key, func(bit uint64) bool {
+		f.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+// MayContain returns false when key was certainly never added.
+func (f *bloomFilter) MayContain(key string) bool {
+	return f.locations(key, func(bit uint64) bool {
+		return f.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+func writeBloomFile(segmentPath string, segmentSize int64, f *bloomFilter) error {
+	prefixLength := len(bloomMagic) + 1 + 8 + 4
+	data := make([]byte, prefixLength, prefixLength+len(f.bits)+4)
+	copy(data, bloomMagic)
+	data[len(bloomMagic)] = bloomVersion
+	binary.LittleEndian.PutUint64(data[len(bloomMagic)+1:], uint64(segmentSize))
+	binary.LittleEndian.PutUint32(data[len(bloomMagic)+1+8:], f.hashCount)
+	data = append(data, f.bits...)
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.Checksum(data, crcTable))
+	data = append(data, sum...)
+
+	tmpPath := bloomFilePath(segmentPath) + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fs.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, bloomFilePath(segmentPath)); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(segmentPath))
+}
+
+func readBloomFile(segmentPath string, segmentSize int64) (*bloomFilter, error) {
+	data, err := os.ReadFile(bloomFilePath(segmentPath))
+	if err != nil {
+		return nil, err
+	}
+	prefixLength := len(bloomMagic) + 1 + 8 + 4
+	if len(data) < prefixLength+1+4 {
+		return nil, errInvalidBloomFile
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(sum) ||
+		string(body[:len(bloomMagic)]) != bloomMagic ||
+		body[len(bloomMagic)] != bloomVersion ||
+		int64(binary.LittleEndian.Uint64(body[len(bloomMagic)+1:])) != segmentSize {
+		return nil, errInvalidBloomFile
+	}
+	hashCount := binary.LittleEndian.Uint32(body[len(bloomMagic)+1+8:])
+	if hashCount == 0 {
+		return nil, errInvalidBloomFile
+	}
+	return &bloomFilter{bits: body[prefixLength:], hashCount: hashCount}, nil
+}
@@ -1,101 +1,125 @@
 package cache
 
 import (
-	"fmt"
 	"github.com/vmihailenco/msgpack/v5"
-	"sync"
 	"time"
 )
 
-const (
-	expireInSeconds = 60 * 5
-)
-
+// MemoryCache is a cache of strings encoded with msgpack, and of values of
+// any type stored as they are, under string keys.
 type MemoryCache struct {
-	l                sync.RWMutex
-	elements         map[string]cacheElement
-	ElementSizeLimit int
-	elementsLength   int
+	values *ShardedCache[string, interface{}]
+	ttl    time.Duration
 }
 
-type cacheElement struct {
-	value         []byte
-	lastUsageTime time.Time
-	usageCount    int
+// Options configures a MemoryCache.
+type Options struct {
+	// MaxBytes bounds the size of the keys and values in the cache.
+	MaxBytes int64
+	// NewPolicy returns the policy that picks the elements a shard of
+	// maxBytes evicts, every shard gets its own. Shards are least recently
+	// used ones when it's nil.
+	NewPolicy func(maxBytes int64) Policy[string]
+	// Shards is how many shards the cache is split into, see NewSharded.
+	// Zero means one.
+	Shards int
+	// OnEvict is called with every element the policy evicted, after the
+	// cache is unlocked.
+	OnEvict func(key string, value interface{})
+	// TTL is how long the elements Set and SetValue store are kept, zero
+	// keeps them until they are evicted.
+	TTL time.Duration
 }
 
+// packed is a string stored with Set.
+type packed []byte
+
+// MewMemoryCache returns a least recently used cache of up to 64 MiB that
+// keeps elements for 5 minutes.
 func MewMemoryCache() *MemoryCache {
-	mc := &MemoryCache{
-		elements:         make(map[string]cacheElement),
-		ElementSizeLimit: 1024,
-		elementsLength:   0,
-	}
-	ticker := time.NewTicker(time.Second * expireInSeconds)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				mc.optimize()
+	return NewMemoryCache(Options{MaxBytes: 64 << 20, TTL: 5 * time.Minute})
+}
+
+// NewMemoryCache returns an empty cache configured by opts.
+func NewMemoryCache(opts Options) *MemoryCache {
+	config := Config[string, interface{}]{MaxBytes: opts.MaxBytes, TTL: opts.TTL}
+	if opts.OnEvict != nil {
+		config.OnEvict = func(key string, value interface{}) {
+			if p, ok := value.(packed); ok {
+				value = p.unpack()
 			}
+			opts.OnEvict(key, value)
 		}
-	}()
-	return mc
+	}
+	return &MemoryCache{values: NewSharded(opts.Shards, config, opts.NewPolicy), ttl: opts.TTL}
 }
 
+// Get returns the string Set stored under key, an empty one when there is
+// none.
 func (m *MemoryCache) Get(key string) string {
-	m.l.RLock()
-	item := ""
-	if e, found := m.elements[key]; found {
-		m.l.RUnlock()
-		if err := msgpack.Unmarshal(e.value, &item); err != nil {
-			panic(err)
-		}
-		e.usageCount += 1
-		e.lastUsageTime = time.Now()
-		m.l.Lock()
-		m.elements[key] = e
-		m.l.Unlock()
-	} else {
-		m.l.RUnlock()
+	value, _ := m.values.Get(key)
+	if p, ok := value.(packed); ok {
+		return p.unpack()
 	}
-	return item
+	return ""
 }
 
 func (m *MemoryCache) Set(key, value string) {
-	m.l.Lock()
-	_, exists := m.elements[key]
-	if !exists {
-		m.elementsLength += 1
-	}
-	if m.elementsLength >= m.ElementSizeLimit {
-		m.optimize()
-	}
+	m.SetWithTTL(key, value, m.ttl)
+}
+
+// SetWithTTL is Set keeping value for ttl, a ttl of zero or less keeps it
+// until it's evicted.
+func (m *MemoryCache) SetWithTTL(key, value string, ttl time.Duration) {
 	valueBytes, err := msgpack.Marshal(value)
 	if err != nil {
 		panic(err)
 	}
-	m.elements[key] = cacheElement{
-		value:         valueBytes,
-		lastUsageTime: time.Now(),
-		usageCount:    0,
+	m.values.set(key, packed(valueBytes), int64(len(key)+len(valueBytes)), ttl)
+}
+
+// GetValue returns the value SetValue stored under key and whether there is
+// one.
+func (m *MemoryCache) GetValue(key string) (interface{}, bool) {
+	value, found := m.values.Get(key)
+	if _, ok := value.(packed); !found || ok {
+		return nil, false
 	}
-	m.l.Unlock()
+	return value, true
 }
 
-func (m *MemoryCache) optimize() {
-	fmt.Println("Starting to optimize memcache!")
-	deletedCount := 0
-	for key := range m.elements {
-		secondsPassedSinceAdded := time.Now().Sub(m.elements[key].lastUsageTime).Seconds()
-		if m.elements[key].usageCount == 0 && secondsPassedSinceAdded > 30 {
-			delete(m.elements, key)
-			deletedCount += 1
-		}
+// SetValue stores value under key as it is, without marshalling it, size is
+// how many bytes it counts for. The value is shared with every GetValue, it
+// must not be modified.
+func (m *MemoryCache) SetValue(key string, value interface{}, size int64) {
+	m.values.set(key, value, size+int64(len(key)), m.ttl)
+}
 
-		if secondsPassedSinceAdded > expireInSeconds {
-			delete(m.elements, key)
-			deletedCount += 1
-		}
+// Delete removes key from the cache.
+func (m *MemoryCache) Delete(key string) {
+	m.values.Delete(key)
+}
+
+// Clear removes every element from the cache.
+func (m *MemoryCache) Clear() {
+	m.values.Clear()
+}
+
+// Stats returns the counters of the cache.
+func (m *MemoryCache) Stats() Stats {
+	return m.values.Stats()
+}
+
+// Close stops removing the expired elements in the background, see
+// Cache.Close.
+func (m *MemoryCache) Close() {
+	m.values.Close()
+}
+
+func (p packed) unpack() string {
+	item := ""
+	if err := msgpack.Unmarshal(p, &item); err != nil {
+		panic(err)
 	}
-	fmt.Printf("Optimizing finished, deleted %d keys!\n", deletedCount)
+	return item
 }
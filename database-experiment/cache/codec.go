@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes the values a Cache stores. A Cache with a codec keeps only
+// the encoded values, every Get decodes its own copy.
+type Codec[V any] interface {
+	Marshal(value V) ([]byte, error)
+	Unmarshal(data []byte, value *V) error
+}
+
+// MsgpackCodec encodes values with msgpack.
+type MsgpackCodec[V any] struct{}
+
+func (MsgpackCodec[V]) Marshal(value V) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (MsgpackCodec[V]) Unmarshal(data []byte, value *V) error {
+	return msgpack.Unmarshal(data, value)
+}
+
+// JSONCodec encodes values as JSON.
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Marshal(value V) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[V]) Unmarshal(data []byte, value *V) error {
+	return json.Unmarshal(data, value)
+}
+
+// BytesCodec stores byte slices as they are, copying them in and out so the
+// cache doesn't share them with its callers.
+type BytesCodec struct{}
+
+func (BytesCodec) Marshal(value []byte) ([]byte, error) {
+	return append([]byte(nil), value...), nil
+}
+
+func (BytesCodec) Unmarshal(data []byte, value *[]byte) error {
+	*value = append([]byte(nil), data...)
+	return nil
+}
@@ -0,0 +1,80 @@
+package cache
+
+import "time"
+
+// expiry is when the element of key expires, it's an item of expiries.
+type expiry[K comparable] struct {
+	key   K
+	at    time.Time
+	index int
+}
+
+// expiries is a min-heap of the elements that expire, the soonest first.
+type expiries[K comparable] []*expiry[K]
+
+func (h expiries[K]) Len() int { return len(h) }
+
+func (h expiries[K]) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiries[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiries[K]) Push(x interface{}) {
+	item := x.(*expiry[K])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiries[K]) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// expireInBackground removes the elements as they expire until the cache is
+// closed. It sleeps until the soonest expiry, a new sooner one wakes it up.
+func (c *Cache[K, V]) expireInBackground() {
+	for {
+		c.l.Lock()
+		next, ok := c.expire(time.Now())
+		c.l.Unlock()
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if ok {
+			timer = time.NewTimer(next)
+			fire = timer.C
+		}
+		select {
+		case <-fire:
+		case <-c.wake:
+		case <-c.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// expire removes the elements expired at now and returns how long until the
+// next one expires, false when none does. It's called under the lock.
+func (c *Cache[K, V]) expire(now time.Time) (time.Duration, bool) {
+	for len(c.expiries) > 0 {
+		soonest := c.expiries[0]
+		if soonest.at.After(now) {
+			return soonest.at.Sub(now), true
+		}
+		c.remove(soonest.key)
+		c.config.Policy.Remove(soonest.key)
+		c.stats.Expirations += 1
+	}
+	return 0, false
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	c := New(Config[string, string]{MaxBytes: 10, TTL: time.Hour})
+	defer c.Close()
+	require.Nil(t, c.SetWithTTL("short", "value", 50*time.Millisecond))
+	require.Nil(t, c.SetWithTTL("forever", "value", 0))
+	require.Nil(t, c.Set("default", "value"))
+	require.Nil(t, c.SetWithTTL("longer", "value", 100*time.Millisecond))
+	require.Nil(t, c.Set("longer", "value"), "overwriting a key replaces its TTL")
+
+	require.Eventually(t, func() bool {
+		return c.Stats().Expirations == 1
+	}, time.Second, 10*time.Millisecond, "expired elements are removed in the background")
+	time.Sleep(100 * time.Millisecond)
+	_, found := c.Get("short")
+	require.False(t, found)
+	for _, key := range []string{"forever", "default", "longer"} {
+		_, found = c.Get(key)
+		require.True(t, found, key)
+	}
+	require.Equal(t, 3, c.Stats().Elements)
+
+	t.Run("close", func(t *testing.T) {
+		goroutines := runtime.NumGoroutine()
+		caches := make([]*MemoryCache, 10)
+		for i := range caches {
+			caches[i] = MewMemoryCache()
+		}
+		for _, c := range caches {
+			c.Close()
+			c.Close()
+		}
+		// require.Eventually checks its condition in a goroutine of its own
+		for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+
+		// closed caches don't return expired elements either, but keep them
+		c := caches[0]
+		c.SetWithTTL("key", "value", time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		require.Equal(t, "", c.Get("key"))
+		require.Equal(t, 1, c.Stats().Elements)
+	})
+}
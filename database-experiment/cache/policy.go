@@ -0,0 +1,282 @@
+package cache
+
+import "container/list"
+
+// Policy picks the elements a Cache evicts once it holds more bytes
+// than it may. The cache calls it under its lock, every method is O(1).
+type Policy[K comparable] interface {
+	// Add tracks key, stored with size bytes. Adding a key that is already
+	// tracked updates its size and counts as an access.
+	Add(key K, size int64)
+	// Access records a hit on key.
+	Access(key K)
+	// Remove stops tracking key, it was deleted rather than evicted.
+	Remove(key K)
+	// Evict stops tracking the key to evict next and returns it, false when
+	// no key is tracked.
+	Evict() (K, bool)
+}
+
+type policyEntry[K comparable] struct {
+	key  K
+	size int64
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy[K comparable] struct {
+	order *list.List
+	keys  map[K]*list.Element
+}
+
+// NewLRU returns a Policy that evicts the least recently used key.
+func NewLRU[K comparable]() Policy[K] {
+	return &lruPolicy[K]{order: list.New(), keys: make(map[K]*list.Element)}
+}
+
+func (p *lruPolicy[K]) Add(key K, size int64) {
+	if e, found := p.keys[key]; found {
+		e.Value.(*policyEntry[K]).size = size
+		p.order.MoveToFront(e)
+		return
+	}
+	p.keys[key] = p.order.PushFront(&policyEntry[K]{key: key, size: size})
+}
+
+func (p *lruPolicy[K]) Access(key K) {
+	if e, found := p.keys[key]; found {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy[K]) Remove(key K) {
+	if e, found := p.keys[key]; found {
+		p.order.Remove(e)
+		delete(p.keys, key)
+	}
+}
+
+func (p *lruPolicy[K]) Evict() (K, bool) {
+	e := p.order.Back()
+	if e == nil {
+		var none K
+		return none, false
+	}
+	key := p.order.Remove(e).(*policyEntry[K]).key
+	delete(p.keys, key)
+	return key, true
+}
+
+// lfuPolicy evicts the least frequently used key, the least recently used
+// one among those used as often. Keys are grouped by their use count in a
+// list of buckets ordered by it, so an access moves a key to the next bucket.
+type lfuPolicy[K comparable] struct {
+	buckets *list.List
+	keys    map[K]*lfuEntry[K]
+}
+
+type lfuBucket struct {
+	count int
+	keys  *list.List
+}
+
+type lfuEntry[K comparable] struct {
+	key    K
+	bucket *list.Element
+	elem   *list.Element
+}
+
+// NewLFU returns a Policy that evicts the least frequently used key.
+func NewLFU[K comparable]() Policy[K] {
+	return &lfuPolicy[K]{buckets: list.New(), keys: make(map[K]*lfuEntry[K])}
+}
+
+func (p *lfuPolicy[K]) Add(key K, size int64) {
+	if _, found := p.keys[key]; found {
+		p.Access(key)
+		return
+	}
+	first := p.buckets.Front()
+	if first == nil || first.Value.(*lfuBucket).count != 1 {
+		first = p.buckets.PushFront(&lfuBucket{count: 1, keys: list.New()})
+	}
+	entry := &lfuEntry[K]{key: key, bucket: first}
+	entry.elem = first.Value.(*lfuBucket).keys.PushFront(entry)
+	p.keys[key] = entry
+}
+
+func (p *lfuPolicy[K]) Access(key K) {
+	entry, found := p.keys[key]
+	if !found {
+		return
+	}
+	current := entry.bucket.Value.(*lfuBucket)
+	next := entry.bucket.Next()
+	if next == nil || next.Value.(*lfuBucket).count != current.count+1 {
+		next = p.buckets.InsertAfter(&lfuBucket{count: current.count + 1, keys: list.New()}, entry.bucket)
+	}
+	p.unlink(entry)
+	entry.bucket = next
+	entry.elem = next.Value.(*lfuBucket).keys.PushFront(entry)
+}
+
+func (p *lfuPolicy[K]) Remove(key K) {
+	if entry, found := p.keys[key]; found {
+		p.unlink(entry)
+		delete(p.keys, key)
+	}
+}
+
+func (p *lfuPolicy[K]) Evict() (K, bool) {
+	first := p.buckets.Front()
+	if first == nil {
+		var none K
+		return none, false
+	}
+	entry := first.Value.(*lfuBucket).keys.Back().Value.(*lfuEntry[K])
+	p.Remove(entry.key)
+	return entry.key, true
+}
+
+// unlink takes entry out of its bucket and drops the bucket once it's empty.
+func (p *lfuPolicy[K]) unlink(entry *lfuEntry[K]) {
+	bucket := entry.bucket.Value.(*lfuBucket)
+	bucket.keys.Remove(entry.elem)
+	if bucket.keys.Len() == 0 {
+		p.buckets.Remove(entry.bucket)
+	}
+}
+
+// arcPolicy is an adaptive replacement cache counted in bytes. Keys used once
+// are in recent and keys used again in frequent, both ordered from the most
+// recently used. Evicted keys are remembered in the ghost lists of the list
+// they were evicted from, a miss on a ghost key moves the target size of
+// recent towards the list that would have kept it.
+type arcPolicy[K comparable] struct {
+	capacity int64
+	// target is how many bytes recent aims to hold
+	target                                       int64
+	recent, frequent, recentGhost, frequentGhost arcList
+	keys                                         map[K]*list.Element
+}
+
+type arcList struct {
+	order *list.List
+	bytes int64
+}
+
+type arcEntry[K comparable] struct {
+	policyEntry[K]
+	in *arcList
+}
+
+// NewARC returns an adaptive replacement Policy for a cache of capacity
+// bytes. It balances between evicting the least recently and the least
+// frequently used keys depending on which would have kept the keys that
+// were requested again after being evicted.
+func NewARC[K comparable](capacity int64) Policy[K] {
+	p := &arcPolicy[K]{capacity: capacity, keys: make(map[K]*list.Element)}
+	for _, l := range []*arcList{&p.recent, &p.frequent, &p.recentGhost, &p.frequentGhost} {
+		l.order = list.New()
+	}
+	return p
+}
+
+func (p *arcPolicy[K]) Add(key K, size int64) {
+	e, found := p.keys[key]
+	if !found {
+		p.push(&p.recent, &arcEntry[K]{policyEntry: policyEntry[K]{key: key, size: size}})
+		p.trimGhosts()
+		return
+	}
+	entry := e.Value.(*arcEntry[K])
+	switch entry.in {
+	case &p.recentGhost:
+		p.target = min64(p.target+size*max64(1, p.frequentGhost.bytes/max64(1, p.recentGhost.bytes)), p.capacity)
+	case &p.frequentGhost:
+		p.target = max64(p.target-size*max64(1, p.recentGhost.bytes/max64(1, p.frequentGhost.bytes)), 0)
+	}
+	p.unlink(e)
+	entry.size = size
+	p.push(&p.frequent, entry)
+	p.trimGhosts()
+}
+
+func (p *arcPolicy[K]) Access(key K) {
+	e, found := p.keys[key]
+	if !found {
+		return
+	}
+	entry := e.Value.(*arcEntry[K])
+	if entry.in != &p.recent && entry.in != &p.frequent {
+		return
+	}
+	p.unlink(e)
+	p.push(&p.frequent, entry)
+}
+
+func (p *arcPolicy[K]) Remove(key K) {
+	if e, found := p.keys[key]; found {
+		p.unlink(e)
+		delete(p.keys, key)
+	}
+}
+
+func (p *arcPolicy[K]) Evict() (K, bool) {
+	from, ghost := &p.frequent, &p.frequentGhost
+	if p.recent.order.Len() > 0 && (p.recent.bytes > p.target || p.frequent.order.Len() == 0) {
+		from, ghost = &p.recent, &p.recentGhost
+	}
+	e := from.order.Back()
+	if e == nil {
+		var none K
+		return none, false
+	}
+	entry := e.Value.(*arcEntry[K])
+	p.unlink(e)
+	p.push(ghost, entry)
+	p.trimGhosts()
+	return entry.key, true
+}
+
+func (p *arcPolicy[K]) push(l *arcList, entry *arcEntry[K]) {
+	entry.in = l
+	l.bytes += entry.size
+	p.keys[entry.key] = l.order.PushFront(entry)
+}
+
+func (p *arcPolicy[K]) unlink(e *list.Element) {
+	entry := e.Value.(*arcEntry[K])
+	entry.in.bytes -= entry.size
+	entry.in.order.Remove(e)
+}
+
+// trimGhosts forgets the oldest ghost keys so that recent and its ghosts hold
+// at most capacity bytes, and all the lists twice as much.
+func (p *arcPolicy[K]) trimGhosts() {
+	for p.recent.bytes+p.recentGhost.bytes > p.capacity && p.recentGhost.order.Len() > 0 {
+		p.forget(&p.recentGhost)
+	}
+	for p.recent.bytes+p.frequent.bytes+p.recentGhost.bytes+p.frequentGhost.bytes > 2*p.capacity && p.frequentGhost.order.Len() > 0 {
+		p.forget(&p.frequentGhost)
+	}
+}
+
+func (p *arcPolicy[K]) forget(ghost *arcList) {
+	e := ghost.order.Back()
+	p.unlink(e)
+	delete(p.keys, e.Value.(*arcEntry[K]).key)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
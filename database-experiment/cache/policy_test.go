@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMemoryCachePolicies(t *testing.T) {
+	// every element takes 10 bytes, a one byte key and a 9 bytes value
+	newCache := func(policy Policy[string], evicted *[]string) *MemoryCache {
+		var newPolicy func(int64) Policy[string]
+		if policy != nil {
+			newPolicy = func(int64) Policy[string] { return policy }
+		}
+		c := NewMemoryCache(Options{
+			MaxBytes:  30,
+			NewPolicy: newPolicy,
+			OnEvict: func(key string, value interface{}) {
+				require.Equal(t, "value "+key, value)
+				*evicted = append(*evicted, key)
+			},
+		})
+		t.Cleanup(c.Close)
+		return c
+	}
+	set := func(c *MemoryCache, keys ...string) {
+		for _, key := range keys {
+			c.SetValue(key, "value "+key, 9)
+		}
+	}
+	get := func(c *MemoryCache, keys ...string) {
+		for _, key := range keys {
+			_, found := c.GetValue(key)
+			require.True(t, found, key)
+		}
+	}
+	requireKeys := func(c *MemoryCache, keys ...string) {
+		t.Helper()
+		for _, key := range keys {
+			_, found := c.GetValue(key)
+			require.True(t, found, key)
+		}
+		require.Equal(t, len(keys), c.Stats().Elements)
+	}
+
+	t.Run("lru", func(t *testing.T) {
+		var evicted []string
+		c := newCache(NewLRU[string](), &evicted)
+		set(c, "a", "b", "c")
+		get(c, "a")
+		set(c, "d")
+		require.Equal(t, []string{"b"}, evicted)
+		requireKeys(c, "a", "c", "d")
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		var evicted []string
+		c := newCache(NewLFU[string](), &evicted)
+		set(c, "a", "b", "c")
+		get(c, "a", "a", "b")
+		set(c, "d", "e")
+		require.Equal(t, []string{"c", "d"}, evicted)
+		requireKeys(c, "a", "b", "e")
+	})
+
+	t.Run("arc", func(t *testing.T) {
+		var evicted []string
+		c := newCache(NewARC[string](30), &evicted)
+		set(c, "a", "b", "c")
+		get(c, "a")
+		set(c, "d")
+		require.Equal(t, []string{"b"}, evicted)
+		// b is requested again after being evicted as a recent key, so
+		// recent keys are kept longer and c goes before the frequent a
+		set(c, "b")
+		require.Equal(t, []string{"b", "c"}, evicted)
+		requireKeys(c, "a", "b", "d")
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		var evicted []string
+		c := newCache(nil, &evicted)
+		set(c, "a", "b", "c", "d")
+		get(c, "b", "c")
+		_, found := c.GetValue("a")
+		require.False(t, found)
+		c.Delete("b")
+		require.Equal(t, Stats{Hits: 2, Misses: 1, Evictions: 1, Bytes: 20, Elements: 2}, c.Stats())
+
+		c.SetValue("c", "too big", 30)
+		_, found = c.GetValue("c")
+		require.False(t, found)
+		require.Equal(t, int64(10), c.Stats().Bytes)
+		c.Clear()
+		require.Equal(t, int64(0), c.Stats().Bytes)
+		require.Equal(t, []string{"a"}, evicted)
+	})
+	t.Run("shards", func(t *testing.T) {
+		var policies []Policy[string]
+		c := NewMemoryCache(Options{MaxBytes: 40, Shards: 4, NewPolicy: func(maxBytes int64) Policy[string] {
+			require.Equal(t, int64(10), maxBytes)
+			policies = append(policies, NewARC[string](maxBytes))
+			return policies[len(policies)-1]
+		}})
+		defer c.Close()
+		require.Len(t, policies, 4, "every shard has a policy of its own")
+
+		require.Panics(t, func() {
+			NewSharded(4, Config[string, int]{Policy: NewLFU[string]()}, nil)
+		}, "a policy can't be shared by the shards")
+	})
+}
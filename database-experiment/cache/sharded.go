@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// ShardedCache spreads its keys over shards that are each a Cache of their
+// own, with their own lock and policy, so that concurrent calls for keys in
+// different shards don't wait for each other.
+type ShardedCache[K comparable, V any] struct {
+	shards []*Cache[K, V]
+}
+
+// NewSharded returns a cache split into shards holding an equal part of
+// config.MaxBytes each. newPolicy returns the policy of a shard of maxBytes,
+// shards are least recently used ones when it's nil. config.Policy can't be
+// shared by several shards, it's only used by a cache of one shard without
+// newPolicy and NewSharded panics when it's set otherwise.
+func NewSharded[K comparable, V any](shards int, config Config[K, V], newPolicy func(maxBytes int64) Policy[K]) *ShardedCache[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+	if config.Policy != nil && (shards > 1 || newPolicy != nil) {
+		panic("cache: Config.Policy is set for a cache of several shards or with newPolicy")
+	}
+	c := &ShardedCache[K, V]{shards: make([]*Cache[K, V], shards)}
+	config.MaxBytes /= int64(shards)
+	for i := range c.shards {
+		if newPolicy != nil {
+			config.Policy = newPolicy(config.MaxBytes)
+		}
+		c.shards[i] = New(config)
+	}
+	return c
+}
+
+// Get returns the value stored under key and whether there is one.
+func (c *ShardedCache[K, V]) Get(key K) (V, bool) {
+	return c.shard(key).Get(key)
+}
+
+// Set stores value under key for the TTL of the cache, see Cache.Set.
+func (c *ShardedCache[K, V]) Set(key K, value V) error {
+	return c.shard(key).Set(key, value)
+}
+
+// SetWithTTL stores value under key for ttl, see Cache.SetWithTTL.
+func (c *ShardedCache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) error {
+	return c.shard(key).SetWithTTL(key, value, ttl)
+}
+
+// GetOrLoad returns the value stored under key, or loads and stores it when
+// there is none, see Cache.GetOrLoad.
+func (c *ShardedCache[K, V]) GetOrLoad(key K, load func(key K) (V, error)) (V, error) {
+	return c.shard(key).GetOrLoad(key, load)
+}
+
+// Delete removes key from the cache.
+func (c *ShardedCache[K, V]) Delete(key K) {
+	c.shard(key).Delete(key)
+}
+
+// Clear removes every element from the cache, one shard at a time.
+func (c *ShardedCache[K, V]) Clear() {
+	for _, shard := range c.shards {
+		shard.Clear()
+	}
+}
+
+// Stats returns the counters of the shards added up.
+func (c *ShardedCache[K, V]) Stats() Stats {
+	var stats Stats
+	for _, shard := range c.shards {
+		s := shard.Stats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Evictions += s.Evictions
+		stats.Expirations += s.Expirations
+		stats.Bytes += s.Bytes
+		stats.Elements += s.Elements
+	}
+	return stats
+}
+
+// Close stops removing the expired elements in the background, see
+// Cache.Close.
+func (c *ShardedCache[K, V]) Close() {
+	for _, shard := range c.shards {
+		shard.Close()
+	}
+}
+
+// set stores value under key for ttl counting it for size bytes, see
+// Cache.set.
+func (c *ShardedCache[K, V]) set(key K, value V, size int64, ttl time.Duration) error {
+	return c.shard(key).set(key, value, size, ttl)
+}
+
+func (c *ShardedCache[K, V]) shard(key K) *Cache[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[hashKey(key)%uint64(len(c.shards))]
+}
+
+// hashKey hashes strings and integers as they are and other keys by how fmt
+// prints them.
+func hashKey[K comparable](key K) uint64 {
+	switch k := any(key).(type) {
+	case string:
+		// fnv-1a, without hash.Hash64 not to allocate on every call
+		hash := uint64(14695981039346656037)
+		for i := 0; i < len(k); i++ {
+			hash ^= uint64(k[i])
+			hash *= 1099511628211
+		}
+		return hash
+	case int:
+		return mix(uint64(k))
+	case int64:
+		return mix(uint64(k))
+	case uint64:
+		return mix(k)
+	case uint32:
+		return mix(uint64(k))
+	case int32:
+		return mix(uint64(k))
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, key)
+	return h.Sum64()
+}
+
+// mix spreads the bits of x so that consecutive integers land in different
+// shards.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
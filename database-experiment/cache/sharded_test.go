@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedCache(t *testing.T) {
+	c := NewSharded(8, Config[int, int]{MaxBytes: 8000}, func(maxBytes int64) Policy[int] {
+		require.Equal(t, int64(1000), maxBytes)
+		return NewLFU[int]()
+	})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for key := i * 50; key < (i+1)*50; key++ {
+				require.Nil(t, c.Set(key, key))
+				value, found := c.Get(key)
+				require.True(t, found)
+				require.Equal(t, key, value)
+				value, err := c.GetOrLoad(-key-1, func(key int) (int, error) { return key, nil })
+				require.Nil(t, err)
+				require.Equal(t, -key-1, value)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stats := c.Stats()
+	require.Equal(t, uint64(400), stats.Hits)
+	require.Equal(t, uint64(400), stats.Misses)
+	require.Equal(t, 800, stats.Elements, "every key is in a single shard")
+	require.Equal(t, int64(800), stats.Bytes)
+
+	for key := 400; key < 20000; key++ {
+		require.Nil(t, c.Set(key, key))
+	}
+	stats = c.Stats()
+	require.LessOrEqual(t, stats.Bytes, int64(8000))
+	require.Greater(t, stats.Elements, 7000, "keys are spread over the shards")
+
+	c.Delete(19999)
+	_, found := c.Get(19999)
+	require.False(t, found)
+	c.Clear()
+	require.Equal(t, 0, c.Stats().Elements)
+}
+
+// baselineCache is the MemoryCache this package started with, reduced to
+// Get and Set: Get finds the element under the read lock and then takes the
+// write lock to count the hit. The benchmarks compare the cache with it.
+type baselineCache struct {
+	l        sync.RWMutex
+	elements map[string]baselineElement
+}
+
+type baselineElement struct {
+	value         []byte
+	lastUsageTime time.Time
+	usageCount    int
+}
+
+func (m *baselineCache) Get(key string) string {
+	m.l.RLock()
+	item := ""
+	if e, found := m.elements[key]; found {
+		m.l.RUnlock()
+		if err := msgpack.Unmarshal(e.value, &item); err != nil {
+			panic(err)
+		}
+		e.usageCount += 1
+		e.lastUsageTime = time.Now()
+		m.l.Lock()
+		m.elements[key] = e
+		m.l.Unlock()
+	} else {
+		m.l.RUnlock()
+	}
+	return item
+}
+
+func (m *baselineCache) Set(key, value string) {
+	valueBytes, err := msgpack.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	m.l.Lock()
+	m.elements[key] = baselineElement{value: valueBytes, lastUsageTime: time.Now()}
+	m.l.Unlock()
+}
+
+// benchmarkCache runs Get in parallel on keys that are all cached, and Set on
+// one out of every writeEvery of them when it's positive.
+func benchmarkCache(b *testing.B, c interface {
+	Get(key string) string
+	Set(key, value string)
+}, writeEvery int) {
+	keys := make([]string, 1<<14)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		c.Set(keys[i], keys[i])
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Int()
+		for pb.Next() {
+			i++
+			key := keys[i&(len(keys)-1)]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				c.Set(key, key)
+			} else {
+				c.Get(key)
+			}
+		}
+	})
+}
+
+// benchmarkCaches runs benchmarkCache on the original cache and on caches of
+// one and of 64 shards.
+func benchmarkCaches(b *testing.B, writeEvery int) {
+	b.Run("baseline", func(b *testing.B) {
+		benchmarkCache(b, &baselineCache{elements: make(map[string]baselineElement)}, writeEvery)
+	})
+	for _, shards := range []int{1, 64} {
+		shards := shards
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := NewMemoryCache(Options{MaxBytes: 1 << 30, Shards: shards})
+			defer c.Close()
+			benchmarkCache(b, c, writeEvery)
+		})
+	}
+}
+
+func BenchmarkCacheReads(b *testing.B) {
+	benchmarkCaches(b, 0)
+}
+
+func BenchmarkCacheMixed(b *testing.B) {
+	benchmarkCaches(b, 10)
+}
@@ -0,0 +1,343 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache keeps at most MaxBytes of values of type V in memory, either as they
+// are or encoded by a Codec. Its Policy decides which elements to evict to
+// stay within MaxBytes, elements with a TTL are removed once they expire by
+// a background goroutine that Close stops. Get only takes the read lock, the
+// hits it records are handed to the policy by the next write, or by a Get
+// that finds the cache unlocked.
+type Cache[K comparable, V any] struct {
+	// hits and misses are updated atomically, they come first to be 64-bit
+	// aligned
+	hits     uint64
+	misses   uint64
+	l        sync.RWMutex
+	elements map[K]element[K, V]
+	config   Config[K, V]
+	bytes    int64
+	stats    Stats
+	accesses accessBuffer[K]
+	expiries expiries[K]
+	// wake tells the background goroutine there is a sooner expiry
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	loadsLock sync.Mutex
+	// loads are the GetOrLoad calls loading a key
+	loads map[K]*loadCall[V]
+}
+
+// Config configures a Cache.
+type Config[K comparable, V any] struct {
+	// MaxBytes bounds the size of the elements in the cache.
+	MaxBytes int64
+	// Policy picks the elements to evict, NewLRU when it's nil.
+	Policy Policy[K]
+	// Codec encodes the values, they are stored as they are when it's nil
+	// and shared with every Get, which must not modify them.
+	Codec Codec[V]
+	// Size returns how many bytes an element counts for. Without it an
+	// element counts for the length of its encoded value, or for one byte
+	// when there's no Codec, which makes MaxBytes bound how many there are.
+	Size func(key K, value V) int64
+	// OnEvict is called with every element the policy evicted, after the
+	// cache is unlocked.
+	OnEvict func(key K, value V)
+	// TTL is how long the elements Set stores are kept, zero keeps them
+	// until they are evicted.
+	TTL time.Duration
+}
+
+// Stats counts the lookups and evictions of a cache.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	// Bytes is the size of the elements in the cache.
+	Bytes    int64
+	Elements int
+}
+
+type element[K comparable, V any] struct {
+	value V
+	// encoded is the value when the cache has a codec
+	encoded []byte
+	size    int64
+	// expiry is nil for an element that doesn't expire
+	expiry *expiry[K]
+}
+
+type loadCall[V any] struct {
+	done  sync.WaitGroup
+	value V
+	err   error
+}
+
+// New returns an empty cache configured by config.
+func New[K comparable, V any](config Config[K, V]) *Cache[K, V] {
+	if config.Policy == nil {
+		config.Policy = NewLRU[K]()
+	}
+	c := &Cache[K, V]{
+		elements: make(map[K]element[K, V]),
+		config:   config,
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		loads:    make(map[K]*loadCall[V]),
+	}
+	go c.expireInBackground()
+	return c
+}
+
+// Close stops removing the expired elements in the background. The cache
+// can still be used, Get doesn't return expired elements, but they are kept
+// until they are evicted, deleted or overwritten.
+func (c *Cache[K, V]) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// Get returns the value stored under key and whether there is one.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.l.RLock()
+	e, found := c.elements[key]
+	if found && e.expiry != nil && !e.expiry.at.After(time.Now()) {
+		found = false
+	}
+	if !found {
+		c.l.RUnlock()
+		atomic.AddUint64(&c.misses, 1)
+		var none V
+		return none, false
+	}
+	recorded := c.accesses.record(key)
+	c.l.RUnlock()
+	if !recorded && c.l.TryLock() {
+		c.accesses.drain(c.config.Policy)
+		c.config.Policy.Access(key)
+		c.l.Unlock()
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return c.decode(e)
+}
+
+// Set stores value under key for the TTL of the cache, it fails only when
+// the codec can't encode it.
+func (c *Cache[K, V]) Set(key K, value V) error {
+	return c.SetWithTTL(key, value, c.config.TTL)
+}
+
+// SetWithTTL stores value under key for ttl, a ttl of zero or less keeps it
+// until it's evicted.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) error {
+	size := int64(1)
+	if c.config.Size != nil {
+		size = c.config.Size(key, value)
+	}
+	return c.set(key, value, size, ttl)
+}
+
+// GetOrLoad returns the value stored under key, or loads and stores it when
+// there is none. Concurrent calls for the same key share a single load, a
+// failed load isn't stored and its error is returned to all of them.
+func (c *Cache[K, V]) GetOrLoad(key K, load func(key K) (V, error)) (V, error) {
+	if value, found := c.Get(key); found {
+		return value, nil
+	}
+	c.loadsLock.Lock()
+	if call, loading := c.loads[key]; loading {
+		c.loadsLock.Unlock()
+		call.done.Wait()
+		return call.value, call.err
+	}
+	call := &loadCall[V]{}
+	call.done.Add(1)
+	c.loads[key] = call
+	c.loadsLock.Unlock()
+
+	defer func() {
+		c.loadsLock.Lock()
+		delete(c.loads, key)
+		c.loadsLock.Unlock()
+		call.done.Done()
+	}()
+	call.value, call.err = load(key)
+	if call.err == nil {
+		call.err = c.Set(key, call.value)
+	}
+	return call.value, call.err
+}
+
+// Delete removes key from the cache.
+func (c *Cache[K, V]) Delete(key K) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if _, exists := c.elements[key]; exists {
+		c.remove(key)
+		c.config.Policy.Remove(key)
+	}
+}
+
+// Clear removes every element from the cache.
+func (c *Cache[K, V]) Clear() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.accesses.drain(c.config.Policy)
+	for key := range c.elements {
+		c.config.Policy.Remove(key)
+	}
+	c.elements = make(map[K]element[K, V])
+	c.expiries = nil
+	c.bytes = 0
+}
+
+// Stats returns the counters of the cache.
+func (c *Cache[K, V]) Stats() Stats {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	stats := c.stats
+	stats.Hits = atomic.LoadUint64(&c.hits)
+	stats.Misses = atomic.LoadUint64(&c.misses)
+	stats.Bytes = c.bytes
+	stats.Elements = len(c.elements)
+	return stats
+}
+
+// set stores value under key for ttl counting it for size bytes, or for the
+// length of its encoding when the cache has a codec and no Size, and evicts
+// elements until the cache is within MaxBytes again. An element bigger than
+// MaxBytes isn't stored, it only removes the previous value of key.
+func (c *Cache[K, V]) set(key K, value V, size int64, ttl time.Duration) error {
+	e := element[K, V]{size: size}
+	if c.config.Codec == nil {
+		e.value = value
+	} else {
+		encoded, err := c.config.Codec.Marshal(value)
+		if err != nil {
+			return err
+		}
+		e.encoded = encoded
+		if c.config.Size == nil {
+			e.size = int64(len(encoded))
+		}
+	}
+	c.l.Lock()
+	c.accesses.drain(c.config.Policy)
+	if _, exists := c.elements[key]; exists {
+		c.remove(key)
+		if e.size > c.config.MaxBytes {
+			c.config.Policy.Remove(key)
+		}
+	}
+	if e.size > c.config.MaxBytes {
+		c.l.Unlock()
+		return nil
+	}
+	if ttl > 0 {
+		e.expiry = &expiry[K]{key: key, at: time.Now().Add(ttl)}
+		heap.Push(&c.expiries, e.expiry)
+		if e.expiry.index == 0 {
+			select {
+			case c.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	c.elements[key] = e
+	c.bytes += e.size
+	c.config.Policy.Add(key, e.size)
+	var evicted []K
+	var elements []element[K, V]
+	for c.bytes > c.config.MaxBytes {
+		victim, ok := c.config.Policy.Evict()
+		if !ok {
+			break
+		}
+		if c.config.OnEvict != nil {
+			evicted = append(evicted, victim)
+			elements = append(elements, c.elements[victim])
+		}
+		c.remove(victim)
+		c.stats.Evictions += 1
+	}
+	c.l.Unlock()
+	for i, key := range evicted {
+		if value, ok := c.decode(elements[i]); ok {
+			c.config.OnEvict(key, value)
+		}
+	}
+	return nil
+}
+
+// decode returns the value of e, false when the codec can't decode it.
+func (c *Cache[K, V]) decode(e element[K, V]) (V, bool) {
+	if c.config.Codec == nil {
+		return e.value, true
+	}
+	var value V
+	if err := c.config.Codec.Unmarshal(e.encoded, &value); err != nil {
+		return value, false
+	}
+	return value, true
+}
+
+// remove deletes key from the elements, leaving the policy as it is.
+func (c *Cache[K, V]) remove(key K) {
+	e := c.elements[key]
+	if e.expiry != nil {
+		heap.Remove(&c.expiries, e.expiry.index)
+	}
+	c.bytes -= e.size
+	delete(c.elements, key)
+}
+
+// accessBufferSize is how many hits a Cache records before they're handed to
+// its policy. A Get that finds the buffer full hands them over if nothing
+// holds the lock, otherwise its hit is left out rather than waiting for it.
+const accessBufferSize = 128
+
+// accessBuffer records the keys Get hits under the read lock, so that they
+// are handed to the policy under the write lock.
+type accessBuffer[K comparable] struct {
+	n    uint32
+	keys [accessBufferSize]K
+}
+
+// record adds key to the buffer and returns false when it's full, it's
+// called under the read lock. Every call claims a slot of its own.
+func (b *accessBuffer[K]) record(key K) bool {
+	if atomic.LoadUint32(&b.n) >= accessBufferSize {
+		return false
+	}
+	i := atomic.AddUint32(&b.n, 1) - 1
+	if i >= accessBufferSize {
+		return false
+	}
+	b.keys[i] = key
+	return true
+}
+
+// drain hands the recorded keys to policy and empties the buffer, it's
+// called under the write lock.
+func (b *accessBuffer[K]) drain(policy Policy[K]) {
+	n := atomic.LoadUint32(&b.n)
+	if n > accessBufferSize {
+		n = accessBufferSize
+	}
+	var none K
+	for i := uint32(0); i < n; i++ {
+		policy.Access(b.keys[i])
+		b.keys[i] = none
+	}
+	atomic.StoreUint32(&b.n, 0)
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type person struct {
+	ID   string   `json:"id"`
+	Name string   `json:"name"`
+	X    []string `json:"x"`
+}
+
+func TestTypedCache(t *testing.T) {
+	p := person{ID: "1", Name: "name", X: []string{"x"}}
+
+	t.Run("codecs", func(t *testing.T) {
+		for name, codec := range map[string]Codec[person]{"msgpack": MsgpackCodec[person]{}, "json": JSONCodec[person]{}} {
+			c := New(Config[string, person]{MaxBytes: 1 << 20, Codec: codec})
+			defer c.Close()
+			require.Nil(t, c.Set("person", p), name)
+			value, found := c.Get("person")
+			require.True(t, found, name)
+			require.Equal(t, p, value, name)
+			value.X[0] = "changed"
+			value, _ = c.Get("person")
+			require.Equal(t, "x", value.X[0], "every Get decodes its own copy")
+		}
+
+		c := New(Config[int, []byte]{MaxBytes: 10, Codec: BytesCodec{}})
+		defer c.Close()
+		data := []byte("12345")
+		require.Nil(t, c.Set(1, data))
+		data[0] = 'x'
+		value, _ := c.Get(1)
+		require.Equal(t, []byte("12345"), value)
+		require.Nil(t, c.Set(2, []byte("123456")))
+		_, found := c.Get(1)
+		require.False(t, found, "elements are sized by their encoding")
+	})
+
+	t.Run("misses aren't empty values", func(t *testing.T) {
+		c := New(Config[string, string]{MaxBytes: 10})
+		defer c.Close()
+		require.Nil(t, c.Set("empty", ""))
+		value, found := c.Get("empty")
+		require.True(t, found)
+		require.Equal(t, "", value)
+		_, found = c.Get("missing")
+		require.False(t, found)
+	})
+
+	t.Run("hits reach the policy", func(t *testing.T) {
+		c := New(Config[string, int]{MaxBytes: 3})
+		defer c.Close()
+		for i, key := range []string{"a", "b", "c"} {
+			require.Nil(t, c.Set(key, i))
+		}
+		// more hits than the buffer holds between two writes, the one
+		// that doesn't fit hands them to the policy as nothing holds the
+		// lock
+		for i := 0; i < accessBufferSize; i++ {
+			c.Get("b")
+		}
+		c.Get("a")
+		require.Nil(t, c.Set("d", 3))
+		for _, key := range []string{"a", "b", "d"} {
+			_, found := c.Get(key)
+			require.True(t, found, key)
+		}
+		_, found := c.Get("c")
+		require.False(t, found)
+	})
+
+	t.Run("reads don't wait for the lock", func(t *testing.T) {
+		c := New(Config[string, int]{MaxBytes: 3})
+		defer c.Close()
+		require.Nil(t, c.Set("a", 1))
+		c.l.RLock()
+		defer c.l.RUnlock()
+		// with a reader holding the lock a full buffer can't be drained,
+		// the hits that don't fit are left out
+		for i := 0; i < 2*accessBufferSize; i++ {
+			_, found := c.Get("a")
+			require.True(t, found)
+		}
+	})
+
+	t.Run("get or load", func(t *testing.T) {
+		c := New(Config[string, int]{MaxBytes: 10})
+		defer c.Close()
+		var loads int32
+		release := make(chan struct{})
+		load := func(key string) (int, error) {
+			atomic.AddInt32(&loads, 1)
+			<-release
+			return len(key), nil
+		}
+		var wg sync.WaitGroup
+		results := make([]int, 10)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				value, err := c.GetOrLoad("key", load)
+				require.Nil(t, err)
+				results[i] = value
+			}(i)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		require.Equal(t, int32(1), atomic.LoadInt32(&loads))
+		for _, result := range results {
+			require.Equal(t, 3, result)
+		}
+		value, found := c.Get("key")
+		require.True(t, found)
+		require.Equal(t, 3, value)
+
+		failed := fmt.Errorf("load failed")
+		_, err := c.GetOrLoad("other", func(string) (int, error) { return 0, failed })
+		require.ErrorIs(t, err, failed)
+		_, found = c.Get("other")
+		require.False(t, found, "failed loads aren't stored")
+	})
+}
@@ -4,23 +4,31 @@ import (
 	db "database-experiment"
 	"database-experiment/index"
 	"encoding/json"
+	"flag"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"sync"
+	"time"
 )
 
 var (
 	database *db.Database
 	wg       sync.WaitGroup
+	dataDir  = flag.String("data-dir", "./data", "directory that holds the segment files")
 )
 
 func main() {
+	flag.Parse()
+	var err error
+	database, err = db.Open(*dataDir, db.Options{})
+	if err != nil {
+		log.Fatalf("Couldn't open database err is: %v\n", err)
+	}
+	defer database.Close()
 	wg.Add(1)
 	go startHttpServer()
-	database = db.NewDatabase()
-	defer database.Close()
 	wg.Wait()
 }
 
@@ -40,9 +48,21 @@ func startHttpServer() {
 		})
 	})
 
+	r.GET("/stats/segments", func(c *gin.Context) {
+		type segmentStats struct {
+			db.SegmentStats
+			GarbageRatio float64
+		}
+		var stats []segmentStats
+		for _, s := range database.SegmentStats() {
+			stats = append(stats, segmentStats{SegmentStats: s, GarbageRatio: s.GarbageRatio()})
+		}
+		c.JSON(200, stats)
+	})
+
 	r.GET("/db/:key", func(c *gin.Context) {
 		key := c.Param("key")
-		val, err := database.Get(key)
+		val, version, err := database.GetWithVersion(key)
 		status := 200
 		errMsg := ""
 		if err != nil {
@@ -54,8 +74,9 @@ func startHttpServer() {
 		}
 
 		c.JSON(status, map[string]interface{}{
-			"value": val,
-			"error": errMsg,
+			"value":   val,
+			"version": version,
+			"error":   errMsg,
 		})
 	})
 
@@ -80,9 +101,26 @@ func startHttpServer() {
 		}
 		marshal, err := json.Marshal(body["value"])
 		if err != nil {
-			panic(err)
+			log.Printf("Couldn't marshal value err is: %v\n", err)
+			c.Status(400)
+			return
+		}
+		// an optional ttl query parameter, like ?ttl=30m, makes the key expire
+		if ttlParam := c.Query("ttl"); ttlParam != "" {
+			ttl, parseErr := time.ParseDuration(ttlParam)
+			if parseErr != nil || ttl <= 0 {
+				c.Status(400)
+				return
+			}
+			err = database.SetWithTTL(key, string(marshal), ttl)
+		} else {
+			err = database.Set(key, string(marshal))
+		}
+		if err != nil {
+			log.Printf("Couldn't set key err is: %v\n", err)
+			c.Status(500)
+			return
 		}
-		database.Set(key, string(marshal))
 		c.Status(200)
 	})
 
@@ -0,0 +1,300 @@
+package databaseexperiment
+
+import (
+	"database-experiment/config"
+	"math"
+	"sort"
+	"time"
+)
+
+// SegmentInfo describes a frozen segment to a CompactionStrategy.
+type SegmentInfo struct {
+	Id          string
+	Level       int
+	Sequence    uint64
+	IsCompacted bool
+	// Size is the size of the segment file in bytes.
+	Size int64
+	// KeyCount is the number of distinct keys in the segment, MinKey and
+	// MaxKey bound them when it isn't zero.
+	KeyCount int
+	MinKey   string
+	MaxKey   string
+	// GarbageRatio is the share of the segment's bytes that a rewrite of it
+	// reclaims, see SegmentStats.ReclaimableRatio.
+	GarbageRatio float64
+}
+
+// overlaps reports whether the key ranges of a and b intersect.
+func (a SegmentInfo) overlaps(b SegmentInfo) bool {
+	return a.KeyCount > 0 && b.KeyCount > 0 && a.MinKey <= b.MaxKey && b.MinKey <= a.MaxKey
+}
+
+// CompactionTask merges Inputs into new segments at OutputLevel. When
+// SplitSize isn't zero the output is split into segments of about that size
+// with disjoint key ranges.
+type CompactionTask struct {
+	Inputs      []SegmentInfo
+	OutputLevel int
+	SplitSize   int64
+}
+
+// CompactionStrategy decides which segments are merged together.
+// Plan gets every frozen segment ordered from the oldest to the newest and
+// returns tasks with disjoint inputs, or nothing when no merge is needed.
+//
+// A merge must not let older data hide newer data: the output takes the
+// place of its newest input in the order, so the inputs of a task have to be
+// consecutive among the segments that share keys with them, and the segments
+// of a level must be newer than the overlapping segments of deeper levels.
+type CompactionStrategy interface {
+	Plan(segments []SegmentInfo) []CompactionTask
+}
+
+// SizeTieredStrategy merges runs of consecutive segments of a similar size,
+// so every byte is rewritten about once per size tier. A segment with too
+// much garbage is rewritten on its own when no run is ready.
+type SizeTieredStrategy struct {
+	// MinThreshold is the number of similar segments that triggers a merge,
+	// 4 when zero.
+	MinThreshold int
+	// MaxThreshold caps the segments merged at once, 32 when zero.
+	MaxThreshold int
+	// BucketLow and BucketHigh bound the size of a segment relative to the
+	// average of a run for it to join the run, 0.5 and 1.5 when zero.
+	BucketLow  float64
+	BucketHigh float64
+	// garbageThreshold is the garbage ratio from which a segment is
+	// rewritten alone, Open sets it to Options.GarbageThreshold.
+	garbageThreshold float64
+}
+
+func NewSizeTieredStrategy() *SizeTieredStrategy {
+	return &SizeTieredStrategy{MinThreshold: 4, MaxThreshold: 32, BucketLow: 0.5, BucketHigh: 1.5}
+}
+
+func (st *SizeTieredStrategy) withDefaults() SizeTieredStrategy {
+	d := *st
+	if d.MinThreshold <= 0 {
+		d.MinThreshold = 4
+	}
+	if d.MaxThreshold < d.MinThreshold {
+		d.MaxThreshold = 32
+	}
+	if d.BucketLow <= 0 {
+		d.BucketLow = 0.5
+	}
+	if d.BucketHigh <= 0 {
+		d.BucketHigh = 1.5
+	}
+	if d.garbageThreshold <= 0 {
+		d.garbageThreshold = config.DefaultGarbageThreshold
+	}
+	return d
+}
+
+func (st *SizeTieredStrategy) Plan(segments []SegmentInfo) []CompactionTask {
+	cfg := st.withDefaults()
+	var tasks []CompactionTask
+	var run []SegmentInfo
+	var runSize int64
+	flush := func() {
+		if len(run) >= cfg.MinThreshold {
+			tasks = append(tasks, CompactionTask{Inputs: run, OutputLevel: run[0].Level})
+		}
+		run, runSize = nil, 0
+	}
+	for _, seg := range segments {
+		if len(run) > 0 && seg.Level != run[0].Level {
+			flush()
+		}
+		if len(run) > 0 {
+			average := float64(runSize) / float64(len(run))
+			if float64(seg.Size) < average*cfg.BucketLow || float64(seg.Size) > average*cfg.BucketHigh || len(run) == cfg.MaxThreshold {
+				flush()
+			}
+		}
+		run = append(run, seg)
+		runSize += seg.Size
+	}
+	flush()
+	if len(tasks) > 0 {
+		return tasks
+	}
+
+	var dirtiest *SegmentInfo
+	for i := range segments {
+		if segments[i].GarbageRatio >= cfg.garbageThreshold &&
+			(dirtiest == nil || segments[i].GarbageRatio > dirtiest.GarbageRatio) {
+			dirtiest = &segments[i]
+		}
+	}
+	if dirtiest != nil {
+		tasks = append(tasks, CompactionTask{Inputs: []SegmentInfo{*dirtiest}, OutputLevel: dirtiest.Level})
+	}
+	return tasks
+}
+
+// LeveledStrategy keeps the segments of every level below level 0 disjoint
+// and every level about LevelMultiplier times larger than the one above it.
+// A merge rewrites one segment together with the few segments of the next
+// level it overlaps, instead of whole levels.
+type LeveledStrategy struct {
+	// L0Trigger is the number of level 0 segments that are merged
+	// into level 1, 4 when zero.
+	L0Trigger int
+	// BaseLevelSize is the target size of level 1 in bytes, ten segments
+	// when zero.
+	BaseLevelSize int64
+	// LevelMultiplier is the growth of the target size from one level to the
+	// next, 10 when zero.
+	LevelMultiplier int
+	// TargetSegmentSize is the size merges split their output at, the
+	// default segment size when zero.
+	TargetSegmentSize int64
+	// MaxLevel is the deepest level, MaxSegmentLevel when zero.
+	MaxLevel int
+}
+
+func NewLeveledStrategy() *LeveledStrategy {
+	return &LeveledStrategy{
+		L0Trigger:         4,
+		BaseLevelSize:     10 * config.DefaultSegmentSizeThreshold,
+		LevelMultiplier:   10,
+		TargetSegmentSize: config.DefaultSegmentSizeThreshold,
+		MaxLevel:          MaxSegmentLevel,
+	}
+}
+
+func (ls *LeveledStrategy) withDefaults() LeveledStrategy {
+	d := *ls
+	if d.L0Trigger <= 0 {
+		d.L0Trigger = 4
+	}
+	if d.TargetSegmentSize <= 0 {
+		d.TargetSegmentSize = config.DefaultSegmentSizeThreshold
+	}
+	if d.BaseLevelSize <= 0 {
+		d.BaseLevelSize = 10 * d.TargetSegmentSize
+	}
+	if d.LevelMultiplier <= 1 {
+		d.LevelMultiplier = 10
+	}
+	if d.MaxLevel <= 0 || d.MaxLevel > MaxSegmentLevel {
+		d.MaxLevel = MaxSegmentLevel
+	}
+	return d
+}
+
+func (ls *LeveledStrategy) Plan(segments []SegmentInfo) []CompactionTask {
+	cfg := ls.withDefaults()
+	levels := make([][]SegmentInfo, cfg.MaxLevel+1)
+	for _, seg := range segments {
+		if seg.Level <= cfg.MaxLevel {
+			levels[seg.Level] = append(levels[seg.Level], seg)
+		}
+	}
+
+	// level 0 segments overlap each other, they all go down together
+	if len(levels[0]) >= cfg.L0Trigger && cfg.MaxLevel > 0 {
+		return []CompactionTask{cfg.mergeInto(levels[0], levels[1], 1)}
+	}
+
+	targetSize := cfg.BaseLevelSize
+	for level := 1; level < cfg.MaxLevel; level++ {
+		var levelSize int64
+		for _, seg := range levels[level] {
+			levelSize += seg.Size
+		}
+		if len(levels[level]) > 0 && levelSize > targetSize {
+			picked := pickSegmentToPushDown(levels[level], levels[level+1])
+			return []CompactionTask{cfg.mergeInto([]SegmentInfo{picked}, levels[level+1], level+1)}
+		}
+		if targetSize > math.MaxInt64/int64(cfg.LevelMultiplier) {
+			break // the deeper levels can't grow too large
+		}
+		targetSize *= int64(cfg.LevelMultiplier)
+	}
+	return nil
+}
+
+// mergeInto returns the task merging inputs with the segments of the next
+// level they overlap.
+func (ls LeveledStrategy) mergeInto(inputs, nextLevel []SegmentInfo, level int) CompactionTask {
+	task := CompactionTask{OutputLevel: level, SplitSize: ls.TargetSegmentSize}
+	task.Inputs = append(task.Inputs, inputs...)
+	for _, seg := range nextLevel {
+		for _, input := range inputs {
+			if seg.overlaps(input) {
+				task.Inputs = append(task.Inputs, seg)
+				break
+			}
+		}
+	}
+	return task
+}
+
+// pickSegmentToPushDown prefers the segment with the most garbage and then
+// the one overlapping the fewest bytes of the next level.
+func pickSegmentToPushDown(level, nextLevel []SegmentInfo) SegmentInfo {
+	overlap := make([]int64, len(level))
+	for i, seg := range level {
+		for _, next := range nextLevel {
+			if seg.overlaps(next) {
+				overlap[i] += next.Size
+			}
+		}
+	}
+	indices := make([]int, len(level))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(a, b int) bool {
+		i, j := indices[a], indices[b]
+		if level[i].GarbageRatio != level[j].GarbageRatio {
+			return level[i].GarbageRatio > level[j].GarbageRatio
+		}
+		return overlap[i] < overlap[j]
+	})
+	return level[indices[0]]
+}
+
+// segmentInfo describes seg, the key range of an immutable segment is
+// computed once and kept with it.
+func segmentInfo(seg Segment) SegmentInfo {
+	header := seg.GetHeader()
+	info := SegmentInfo{
+		Id:          seg.GetId(),
+		Level:       int(header.Level),
+		Sequence:    header.Sequence,
+		IsCompacted: header.IsCompacted,
+	}
+	if stat, err := seg.GetFileInfo(); err == nil {
+		info.Size = stat.Size()
+	}
+	if immutable, ok := seg.(*immutableSegment); ok {
+		immutable.keyRangeOnce.Do(immutable.computeKeyRange)
+		info.KeyCount = immutable.keyRange.keyCount
+		info.MinKey, info.MaxKey = immutable.keyRange.minKey, immutable.keyRange.maxKey
+		info.GarbageRatio = immutable.usageStats(time.Now()).ReclaimableRatio()
+	}
+	return info
+}
+
+type segmentKeyRange struct {
+	keyCount int
+	minKey   string
+	maxKey   string
+}
+
+func (r *immutableSegment) computeKeyRange() {
+	keys, err := segmentKeysInRange(r, "", "")
+	if err != nil {
+		r.logger.Printf("couldn't collect the key range of segment %s: %v\n", r.id, err)
+		return
+	}
+	r.keyRange.keyCount = len(keys)
+	if len(keys) > 0 {
+		r.keyRange.minKey, r.keyRange.maxKey = keys[0], keys[len(keys)-1]
+	}
+}
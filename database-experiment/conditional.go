@@ -0,0 +1,73 @@
+package databaseexperiment
+
+import (
+	"database-experiment/index"
+	"errors"
+	"math"
+)
+
+var (
+	// ErrVersionMismatch is returned by the conditional writes when the key
+	// isn't at the version they expect.
+	ErrVersionMismatch = errors.New("key is not at the expected version")
+)
+
+// GetWithVersion is Get that also returns the version of key, the sequence
+// number of its newest write. Conditional writes expect it to be unchanged.
+func (db *Database) GetWithVersion(key string) (interface{}, uint64, error) {
+	pmTotalReads.Inc()
+	return db.getCached(key)
+}
+
+// CompareAndSwap sets key to value if its version is still expectedVersion
+// and returns the new version, otherwise it returns ErrVersionMismatch. A key
+// that doesn't exist, was deleted or expired is at version zero.
+func (db *Database) CompareAndSwap(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	return db.writeIfVersion(DBRow{Key: key, Value: value}, expectedVersion)
+}
+
+// SetIfNotExists sets key to value unless it exists and returns the new
+// version, otherwise it returns ErrVersionMismatch.
+func (db *Database) SetIfNotExists(key string, value interface{}) (uint64, error) {
+	return db.CompareAndSwap(key, 0, value)
+}
+
+// DeleteIfVersion deletes key if its version is still expectedVersion,
+// otherwise it returns ErrVersionMismatch.
+func (db *Database) DeleteIfVersion(key string, expectedVersion uint64) error {
+	_, err := db.writeIfVersion(DBRow{Key: key, Type: RecordTypeTombstone}, expectedVersion)
+	return err
+}
+
+// writeIfVersion writes row if its key is at expectedVersion and returns the
+// sequence number of row. The version is checked under commitLock, which
+// every write holds, so no other write gets in between.
+func (db *Database) writeIfVersion(row DBRow, expectedVersion uint64) (uint64, error) {
+	pmTotalWrites.Inc()
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+	version, err := db.currentVersion(row.Key)
+	if err != nil {
+		return 0, err
+	}
+	if version != expectedVersion {
+		pmTotalMismatches.Inc()
+		return 0, ErrVersionMismatch
+	}
+	rows := []DBRow{row}
+	if err = db.appendRows(rows, false); err != nil {
+		db.opts.Logger.Printf("couldn't write key %s conditionally err is: %v\n", row.Key, err)
+		return 0, err
+	}
+	db.checkCurrentSegmentSizeInBackground()
+	return rows[0].Seq, nil
+}
+
+// currentVersion returns the version of key, zero when it doesn't exist.
+func (db *Database) currentVersion(key string) (uint64, error) {
+	_, version, err := db.getVersionAt(key, math.MaxUint64)
+	if err == index.ErrKeyNotFound {
+		return 0, nil
+	}
+	return version, err
+}
@@ -1,5 +1,9 @@
 package config
 
+import "time"
+
 const (
-	DataFilesFolderPath = "/Users/serkanerip/workspace/tmp"
+	DefaultSegmentSizeThreshold = 32_000_000
+	DefaultCompactionInterval   = time.Minute * 5
+	DefaultGarbageThreshold     = 0.5
 )
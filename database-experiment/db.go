@@ -1,145 +1,498 @@
 package databaseexperiment
 
 import (
-	"database-experiment/config"
 	"database-experiment/index"
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	tombstoneValue = "$__TOMBSTONE__$"
+var (
+	errDatabaseClosed = errors.New("database is already closed")
+	errInvalidTTL     = errors.New("ttl must be positive")
 )
 
 type Database struct {
-	currentSegment                   *writableSegment
-	segmentSizeThreshold             int64
-	frozenSegments                   *Segments
-	segmentLock                      sync.Mutex
-	newWritableSegmentInitInProgress bool
+	dir  string
+	opts Options
+	// currentSegment holds the *writableSegment writes append to, it's
+	// replaced under commitLock and loaded without a lock, see current.
+	currentSegment atomic.Value
+	frozenSegments *Segments
+	segmentLock    sync.Mutex
+	// newWritableSegmentInitInProgress is 1 while a size check freezes the
+	// current segment, it's set with a compare and swap.
+	newWritableSegmentInitInProgress int32
+	closeOnce                        sync.Once
+	done                             chan struct{}
+	background                       sync.WaitGroup
+	// backgroundLock orders the goroutines goInBackground starts with the
+	// Wait of Close, no new one starts once closed is set
+	backgroundLock  sync.Mutex
+	closed          bool
+	segmentSequence uint64
+
+	// commitLock serializes sequence number assignment, so writes become
+	// visible in the order of their sequence numbers.
+	commitLock sync.Mutex
+	// lastSeq is the sequence number of the newest visible write.
+	lastSeq uint64
+
+	snapshotsLock sync.Mutex
+	// snapshots counts the open transactions reading at each sequence number.
+	snapshots map[uint64]int
+
+	// readCache is nil unless Options.CacheSize is set
+	readCache *readCache
 }
 
-func NewDatabase() *Database {
+// Open opens the database stored in dir, recovering the segments found there.
+// The directory is created when it doesn't exist.
+func Open(dir string, opts Options) (*Database, error) {
+	opts = opts.withDefaults()
 	db := &Database{
-		segmentSizeThreshold:             32_000_000,
-		frozenSegments:                   NewSegments(),
-		newWritableSegmentInitInProgress: false,
-	}
-	db.findSegments()
-	db.frozenSegments.Recover()
-	db.frozenSegments.Compaction()
-	db.frozenSegments.Merge()
-	db.currentSegment = NewWritableSegment(
-		getFileAbsolutePath(generateDataFileName()),
-		index.NewHashMapIndex(),
-	)
-
-	ticker := time.NewTicker(time.Minute * 5)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				if !db.frozenSegments.compactionInProgress {
-					db.frozenSegments.Compaction()
+		dir:            dir,
+		opts:           opts,
+		frozenSegments: NewSegments(dir, opts),
+		done:           make(chan struct{}),
+		snapshots:      map[uint64]int{},
+	}
+	if opts.CacheSize > 0 {
+		db.readCache = newReadCache(opts.CacheSize)
+	}
+	db.frozenSegments.retentionFloor = db.oldestSnapshot
+	db.frozenSegments.inCurrentSegment = func(key string) bool {
+		current := db.current()
+		return current != nil && current.shadows(key)
+	}
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return nil, err
+	}
+	err := db.findSegments()
+	if err == nil {
+		err = db.frozenSegments.Recover()
+	}
+	if err == nil {
+		db.lastSeq = db.frozenSegments.manifest.lastSeq
+		segments := db.frozenSegments.snapshot()
+		for _, seg := range segments {
+			if seg.MaxSeq() > db.lastSeq {
+				db.lastSeq = seg.MaxSeq()
+			}
+		}
+		releaseSegments(segments, opts.Logger)
+		err = db.frozenSegments.Compaction()
+	}
+	if err == nil {
+		err = db.frozenSegments.Merge()
+	}
+	var current *writableSegment
+	if err == nil {
+		current, err = db.newWritableSegment()
+	}
+	if err != nil {
+		db.frozenSegments.Close()
+		return nil, err
+	}
+	db.currentSegment.Store(current)
+
+	db.background.Add(1)
+	go db.runCompactionLoop()
+
+	opts.Logger.Println("Database is ready!")
+	return db, nil
+}
+
+func (db *Database) runCompactionLoop() {
+	defer db.background.Done()
+	ticker := time.NewTicker(db.opts.CompactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !db.frozenSegments.IsCompactionInProgress() {
+				if err := db.frozenSegments.Compaction(); err != nil {
+					db.opts.Logger.Println("Compaction failed: ", err)
 				}
-				if !db.frozenSegments.mergeInProgress {
-					db.frozenSegments.Merge()
+			}
+			if db.frozenSegments.claimMerge() {
+				if err := db.frozenSegments.runClaimedMerge(); err != nil {
+					db.opts.Logger.Println("Merge failed: ", err)
 				}
-			default:
 			}
+		case <-db.done:
+			return
 		}
-	}()
+	}
+}
 
-	fmt.Println("Database is ready!")
-	return db
+// Close stops the background compaction, waits for the in-flight segment
+// size checks and closes every segment file.
+func (db *Database) Close() error {
+	err := errDatabaseClosed
+	db.closeOnce.Do(func() {
+		close(db.done)
+		db.backgroundLock.Lock()
+		db.closed = true
+		db.backgroundLock.Unlock()
+		db.background.Wait()
+		current := db.current()
+		current.usage.release()
+		err = current.Close()
+		if frozenErr := db.frozenSegments.Close(); err == nil {
+			err = frozenErr
+		}
+		if db.readCache != nil {
+			db.readCache.values.Close()
+		}
+	})
+	return err
 }
 
-func (db *Database) Close() {
-	err := db.currentSegment.Close()
+func (db *Database) Get(key string) (interface{}, error) {
+	pmTotalReads.Inc()
+	value, _, err := db.getCached(key)
+	return value, err
+}
+
+// getAt returns the value key had at sequence number seq.
+func (db *Database) getAt(key string, seq uint64) (interface{}, error) {
+	value, _, err := db.getVersionAt(key, seq)
+	return value, err
+}
+
+// getVersionAt returns the value key had at sequence number seq and the
+// sequence number it was written at.
+func (db *Database) getVersionAt(key string, seq uint64) (interface{}, uint64, error) {
+	row, err := db.lookup(key, seq)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
+	if row.isTombstone() || row.isExpired(time.Now()) {
+		return nil, 0, index.ErrKeyNotFound
+	}
+	return row.Value, row.Seq, nil
 }
 
-func (db *Database) Get(key string) (interface{}, error) {
-	pmTotalReads.Inc()
-	data, err := db.currentSegment.Read(key)
-	if err == nil {
-		if data.(string) == tombstoneValue {
-			return nil, index.ErrKeyNotFound
+// lookup returns the newest row of key with a sequence number of at most seq,
+// searching the current segment first and then the frozen segments from the
+// newest to the oldest. The row may be a tombstone.
+func (db *Database) lookup(key string, seq uint64) (DBRow, error) {
+	segments := db.readSegments()
+	defer releaseSegments(segments, db.opts.Logger)
+	row, err := findRowAt(segments, key, seq)
+	if err != nil && err != index.ErrKeyNotFound {
+		db.opts.Logger.Println("Segment read error: ", err)
+	}
+	return row, err
+}
+
+// readSegments returns the segments from the newest to the oldest: the
+// current one and then the frozen ones. It holds a reference to each of them
+// that the caller gives up with releaseSegments.
+func (db *Database) readSegments() []Segment {
+	// the current segment is listed before the frozen ones, a segment frozen
+	// in between shows up twice instead of not at all
+	segments := []Segment{db.acquireCurrentSegment()}
+	frozen := db.frozenSegments.snapshot()
+	for i := len(frozen) - 1; i > -1; i-- {
+		segments = append(segments, frozen[i])
+	}
+	return segments
+}
+
+// acquireCurrentSegment returns the current segment holding a reference to
+// it. A segment that was frozen and rewritten since it was loaded can't be
+// acquired anymore, the current segment replaced it by then.
+func (db *Database) acquireCurrentSegment() *writableSegment {
+	for {
+		seg := db.current()
+		if seg.acquire() {
+			return seg
 		}
-		return data, nil
 	}
-	if err != index.ErrKeyNotFound {
-		return nil, err
+}
+
+// writeRows assigns the next sequence numbers to rows and appends them to the
+// current segment.
+func (db *Database) writeRows(rows []DBRow, batch bool) error {
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+	return db.appendRows(rows, batch)
+}
+
+// appendRows is writeRows for callers already holding commitLock.
+func (db *Database) appendRows(rows []DBRow, batch bool) error {
+	seq := atomic.LoadUint64(&db.lastSeq)
+	creationTime := time.Now().Unix()
+	for i := range rows {
+		seq++
+		rows[i].Seq = seq
+		rows[i].CreationTime = creationTime
 	}
-	data, err = db.frozenSegments.FindKeyInsideSegments(key)
-	if err != nil {
-		panic(err)
+	if err := db.current().writeRows(rows, batch); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&db.lastSeq, seq)
+	if db.readCache != nil {
+		db.readCache.invalidate(rows)
 	}
-	return data, nil
+	return nil
 }
 
 func (db *Database) Set(key string, value interface{}) error {
 	pmTotalWrites.Inc()
-	err := db.currentSegment.Write(key, value)
+	err := db.writeRows([]DBRow{{Key: key, Value: value}}, false)
+	if err != nil {
+		db.opts.Logger.Printf("couldn't set key %s err is: %v\n", key, err)
+		return err
+	}
+	db.checkCurrentSegmentSizeInBackground()
+	return nil
+}
+
+// SetWithTTL sets key to value until ttl passes, after that the key reads as
+// not found and compaction reclaims it.
+func (db *Database) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errInvalidTTL
+	}
+	pmTotalWrites.Inc()
+	row := DBRow{Key: key, Value: value, ExpiresAt: time.Now().Add(ttl).UnixNano()}
+	err := db.writeRows([]DBRow{row}, false)
 	if err != nil {
-		fmt.Printf("couldn't set key %s err is: %v\n", key, err)
+		db.opts.Logger.Printf("couldn't set key %s err is: %v\n", key, err)
 		return err
 	}
-	go db.checkCurrentSegmentSize()
+	db.checkCurrentSegmentSizeInBackground()
 	return nil
 }
 
+func (db *Database) checkCurrentSegmentSizeInBackground() {
+	db.goInBackground(db.checkCurrentSegmentSize)
+}
+
+// goInBackground runs f in a goroutine Close waits for, it returns false and
+// doesn't run f once the database is closed.
+func (db *Database) goInBackground(f func()) bool {
+	db.backgroundLock.Lock()
+	defer db.backgroundLock.Unlock()
+	if db.closed {
+		return false
+	}
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		f()
+	}()
+	return true
+}
+
+// mergeInBackground lets the compaction strategy react to a new segment
+// without waiting for the next compaction interval. It does nothing while
+// another background merge is running or about to.
+func (db *Database) mergeInBackground() {
+	if !db.frozenSegments.claimMerge() {
+		return
+	}
+	// a closed database keeps the claim, it doesn't merge anymore
+	db.goInBackground(func() {
+		if err := db.frozenSegments.runClaimedMerge(); err != nil {
+			db.opts.Logger.Println("Merge failed: ", err)
+		}
+	})
+}
+
 func (db *Database) checkCurrentSegmentSize() {
-	fileInfo := db.currentSegment.GetFileInfo()
-	currentSegmentSize := fileInfo.Size()
-	if currentSegmentSize < db.segmentSizeThreshold ||
+	currentSegmentSize := db.current().size()
+	if currentSegmentSize < db.opts.SegmentSize ||
 		db.frozenSegments.IsCompactionInProgress() ||
-		db.newWritableSegmentInitInProgress {
+		!atomic.CompareAndSwapInt32(&db.newWritableSegmentInitInProgress, 0, 1) {
 		return
 	}
-	db.newWritableSegmentInitInProgress = true
-	fmt.Println("Froze current segment it exceeded the threshold! Size: ", currentSegmentSize)
+	defer atomic.StoreInt32(&db.newWritableSegmentInitInProgress, 0)
+	db.opts.Logger.Println("Froze current segment it exceeded the threshold! Size: ", currentSegmentSize)
 	db.initNewWritableSegment()
-	db.newWritableSegmentInitInProgress = false
+}
+
+// current returns the segment writes append to, nil until Open created it.
+func (db *Database) current() *writableSegment {
+	seg, _ := db.currentSegment.Load().(*writableSegment)
+	return seg
 }
 
 func (db *Database) initNewWritableSegment() {
 	if !db.segmentLock.TryLock() {
 		return // another process is doing check at the moment
 	}
-	fileName := generateDataFileName()
-	oldSegment := db.currentSegment
-	db.currentSegment = NewWritableSegment(
-		getFileAbsolutePath(fileName),
-		index.NewHashMapIndex())
+	oldSegment := db.current()
+	newSegment, err := db.newWritableSegment()
+	if err != nil {
+		db.segmentLock.Unlock()
+		db.opts.Logger.Println("couldn't create a new writable segment, keep writing to the current one: ", err)
+		return
+	}
+	// writes append while holding commitLock, once it's taken here nothing
+	// reaches the old segment anymore. The old segment is frozen before it's
+	// replaced, so a reader always finds its keys in one place or the other.
+	db.commitLock.Lock()
+	frozenSegment := oldSegment.getImmutableSegment()
+	db.frozenSegments.Add(frozenSegment)
+	db.currentSegment.Store(newSegment)
+	db.commitLock.Unlock()
 	db.segmentLock.Unlock()
-	db.frozenSegments.Add(oldSegment.getImmutableSegment())
-	fmt.Println("Frozed old segment and new segment created!")
+	// rewrites consult the range tombstones of the frozen segment now
+	oldSegment.rangeShadows.release()
+	db.opts.Logger.Println("Frozed old segment and new segment created!")
+	if db.opts.Storage == LSMStorage {
+		err := db.frozenSegments.Flush(frozenSegment)
+		if err == nil {
+			db.mergeInBackground()
+			return
+		}
+		db.opts.Logger.Println("couldn't flush memtable to an sstable, the next compaction retries: ", err)
+	}
+	if err := oldSegment.WriteHint(); err != nil {
+		db.opts.Logger.Printf("couldn't write hint file of segment %s: %v\n", oldSegment.GetId(), err)
+	}
+	frozenSegment.buildFilter()
 }
 
-func (db *Database) findSegments() {
-	fileInfos, err := ioutil.ReadDir(config.DataFilesFolderPath)
+// newWritableSegment creates the next current segment, its writes count the
+// versions they supersede in the frozen segments as garbage.
+func (db *Database) newWritableSegment() (*writableSegment, error) {
+	newSegment, err := NewWritableSegment(
+		getFileAbsolutePath(db.dir, generateDataFileName()),
+		db.nextSegmentHeader(),
+		db.opts.IndexFactory(),
+		db.opts.Logger)
 	if err != nil {
-		panic(err)
-		return
+		return nil, err
 	}
+	if err = db.frozenSegments.register(newSegment); err != nil {
+		newSegment.Close()
+		os.Remove(newSegment.readFile.Name())
+		return nil, err
+	}
+	newSegment.onFirstWrite = db.frozenSegments.supersede
+	newSegment.onRangeDelete = func(start, end string, record index.Record) {
+		db.supersedeRangeInBackground(newSegment, start, end, record)
+	}
+	newSegment.usage.publish()
+	return newSegment, nil
+}
+
+// SegmentStats returns the live and dead records of every segment, the
+// frozen ones from the oldest to the newest and then the current one.
+func (db *Database) SegmentStats() []SegmentStats {
+	now := time.Now()
+	var stats []SegmentStats
+	segments := db.frozenSegments.snapshot()
+	defer releaseSegments(segments, db.opts.Logger)
+	for _, seg := range segments {
+		if immutable, ok := seg.(*immutableSegment); ok {
+			stats = append(stats, immutable.usageStats(now))
+		}
+	}
+	current := db.current().usageStats(now)
+	current.Current = true
+	return append(stats, current)
+}
 
+// findSegments opens the segments the manifest lists as live and removes
+// every other segment file. A database without a manifest, created before
+// it existed, opens the segment files it finds instead and starts one.
+func (db *Database) findSegments() error {
+	m, err := openManifest(db.dir, db.opts.Logger)
+	if errors.Is(err, fs.ErrNotExist) {
+		return db.findSegmentsWithoutManifest()
+	}
+	if err != nil {
+		return err
+	}
+	db.frozenSegments.manifest = m
+	if err = m.removeOrphanedFiles(); err != nil {
+		return err
+	}
+	for _, id := range m.liveIds() {
+		seg, err := NewImmutableSegment(getFileAbsolutePath(db.dir, id), db.opts.IndexFactory(), db.opts.Logger)
+		if err != nil {
+			return fmt.Errorf("couldn't open segment %s listed in the manifest: %w", id, err)
+		}
+		db.addRecoveredSegment(seg)
+	}
+	db.frozenSegments.Sort()
+	return nil
+}
+
+func (db *Database) findSegmentsWithoutManifest() error {
+	fileInfos, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	var segmentNumber uint64
+	var ids []string
 	for _, fileInfo := range fileInfos {
 		fileName := fileInfo.Name()
-		absolutePath := getFileAbsolutePath(fileName)
-		if strings.Contains(fileName, ".data") {
-			db.frozenSegments.Add(NewImmutableSegment(absolutePath, index.NewHashMapIndex()))
+		absolutePath := getFileAbsolutePath(db.dir, fileName)
+		if strings.HasSuffix(fileName, ".migrating") {
+			// left behind by a migration that didn't finish, the legacy file is still in place
+			if err = os.Remove(absolutePath); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isSegmentFile(fileName) {
+			continue
+		}
+		// segments written before headers existed are ordered by their file
+		// names, which start with the creation time
+		segmentNumber++
+		seg, err := NewImmutableSegment(absolutePath, db.opts.IndexFactory(), db.opts.Logger)
+		if errors.Is(err, errNoSegmentHeader) {
+			if err = migrateLegacySegment(absolutePath, segmentNumber, db.opts.Logger); err != nil {
+				return err
+			}
+			seg, err = NewImmutableSegment(absolutePath, db.opts.IndexFactory(), db.opts.Logger)
 		}
+		if err != nil {
+			return err
+		}
+		db.addRecoveredSegment(seg)
+		ids = append(ids, seg.GetId())
 	}
 
 	db.frozenSegments.Sort()
+	db.frozenSegments.manifest, err = createManifest(db.dir, ids, db.opts.Logger)
+	return err
+}
+
+func (db *Database) addRecoveredSegment(seg Segment) {
+	if seq := seg.GetHeader().Sequence; seq > db.segmentSequence {
+		db.segmentSequence = seq
+	}
+	db.frozenSegments.Add(seg)
 }
 
-func (db *Database) Delete(s string) error {
-	return db.Set(s, tombstoneValue)
+func (db *Database) nextSegmentHeader() SegmentHeader {
+	return SegmentHeader{Sequence: atomic.AddUint64(&db.segmentSequence, 1)}
+}
+
+// Delete removes key by writing a tombstone for it.
+func (db *Database) Delete(key string) error {
+	pmTotalWrites.Inc()
+	err := db.writeRows([]DBRow{{Key: key, Type: RecordTypeTombstone}}, false)
+	if err != nil {
+		db.opts.Logger.Printf("couldn't delete key %s err is: %v\n", key, err)
+		return err
+	}
+	db.checkCurrentSegmentSizeInBackground()
+	return nil
 }
@@ -2,13 +2,22 @@ package databaseexperiment
 
 import (
 	"database-experiment/index"
+	"encoding/binary"
 	"fmt"
 	"github.com/bxcodec/faker/v3"
 	"github.com/go-playground/assert/v2"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"io/fs"
+	"log"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,7 +32,7 @@ type Person struct {
 }
 
 func TestKeyDeletion(t *testing.T) {
-	db := NewDatabase()
+	db := openDatabase(t, t.TempDir(), Options{})
 	err := db.Set("x", "y")
 	require.Nil(t, err)
 
@@ -39,7 +48,7 @@ func TestKeyDeletion(t *testing.T) {
 }
 
 func TestKeyDeletionAfterCompactionAndMerge(t *testing.T) {
-	db := NewDatabase()
+	db := openDatabase(t, t.TempDir(), Options{})
 	err := db.Set("x", "y")
 	require.Nil(t, err)
 
@@ -58,11 +67,11 @@ func TestKeyDeletionAfterCompactionAndMerge(t *testing.T) {
 }
 
 func TestDb(t *testing.T) {
-	db := NewDatabase()
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
 	createdPersons := createSomeData(t, db, 40, 400)
 
 	assert.Equal(t, len(createdPersons), 40*400)
-	db.Close()
 
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(createdPersons), func(i, j int) { createdPersons[i], createdPersons[j] = createdPersons[j], createdPersons[i] })
@@ -70,10 +79,16 @@ func TestDb(t *testing.T) {
 	assert.Equal(t, nil, validateDataExistence(db, createdPersons))
 
 	db.Close()
-	db = NewDatabase()
+	db = openDatabase(t, dir, Options{})
 	assert.Equal(t, nil, validateDataExistence(db, createdPersons))
 }
 
+func openDatabase(t *testing.T, dir string, opts Options) *Database {
+	db, err := Open(dir, opts)
+	require.Nil(t, err)
+	return db
+}
+
 func validateDataExistence(db *Database, dataIds []string) error {
 	for i := range dataIds {
 		_, err := db.Get(dataIds[i])
@@ -111,3 +126,1590 @@ func createSomeData(t *testing.T, db *Database, jobCount, jobPersonCount int) []
 	wg.Wait()
 	return createdPersons
 }
+
+func TestCorruptRecordIsDetected(t *testing.T) {
+	dir := t.TempDir()
+	path := getFileAbsolutePath(dir, generateDataFileName())
+	ws, err := NewWritableSegment(path, SegmentHeader{Sequence: 1}, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	require.Nil(t, ws.Write("a", "first"))
+	require.Nil(t, ws.Write("b", "second"))
+	require.Nil(t, ws.Close())
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	data[headerLength+recordHeaderSize+2] ^= 0xff
+	require.Nil(t, os.WriteFile(path, data, 0644))
+
+	seg, err := NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	defer seg.Close()
+	var corruptErr *ErrCorruptRecord
+	require.ErrorAs(t, seg.RecoverIndex(), &corruptErr, "corruption in the middle of a segment is fatal")
+	require.Equal(t, seg.GetId(), corruptErr.SegmentId)
+	require.Equal(t, int64(headerLength), corruptErr.Offset)
+
+	seg.GetIndexStrategy().Set("a", index.Record{Offset: strconv.FormatInt(corruptErr.Offset, 16)})
+	_, err = seg.Read("a")
+	require.ErrorAs(t, err, &corruptErr)
+}
+
+func TestTornTailIsTruncated(t *testing.T) {
+	tails := map[string]func(lastRecord []byte) []byte{
+		"partial length prefix": func(lastRecord []byte) []byte { return lastRecord[:5] },
+		"short payload":         func(lastRecord []byte) []byte { return lastRecord[:len(lastRecord)-3] },
+		"bad checksum": func(lastRecord []byte) []byte {
+			torn := append([]byte{}, lastRecord...)
+			torn[len(torn)-1] ^= 0xff
+			return torn
+		},
+		"zero filled": func(lastRecord []byte) []byte { return make([]byte, len(lastRecord)) },
+	}
+	for name, tear := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := openDatabase(t, dir, Options{})
+			require.Nil(t, db.Set("a", "first"))
+			require.Nil(t, db.Set("b", "second"))
+			path := db.current().readFile.Name()
+			goodSize := db.current().size()
+			db.Close()
+
+			lastRecord, err := encodeRecord(&DBRow{Key: "c", Value: "third", Offset: formatOffset(goodSize)})
+			require.Nil(t, err)
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			require.Nil(t, err)
+			_, err = file.Write(tear(lastRecord))
+			require.Nil(t, err)
+			require.Nil(t, file.Close())
+
+			seg, err := NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+			require.Nil(t, err)
+			seg.(*immutableSegment).mayBeTorn = true
+			require.Nil(t, seg.RecoverIndex())
+			require.Nil(t, seg.Close())
+			stat, err := os.Stat(path)
+			require.Nil(t, err)
+			require.Equal(t, goodSize, stat.Size())
+
+			db = openDatabase(t, dir, Options{})
+			defer db.Close()
+			value, err := db.Get("b")
+			require.Nil(t, err)
+			require.Equal(t, "second", value)
+		})
+	}
+}
+
+func TestCorruptionIsNotATornTail(t *testing.T) {
+	requireCorrupt := func(t *testing.T, dir, path string) {
+		before, err := os.ReadFile(path)
+		require.Nil(t, err)
+		_, err = Open(dir, Options{})
+		var corruptErr *ErrCorruptRecord
+		require.ErrorAs(t, err, &corruptErr)
+		after, err := os.ReadFile(path)
+		require.Nil(t, err)
+		require.Equal(t, before, after, "nothing is cut off")
+	}
+
+	t.Run("damaged length", func(t *testing.T) {
+		dir := t.TempDir()
+		db := openDatabase(t, dir, Options{})
+		var offsets []int64
+		for _, key := range []string{"a", "b", "c", "d"} {
+			offsets = append(offsets, db.current().size())
+			require.Nil(t, db.Set(key, "value"))
+		}
+		path := db.current().readFile.Name()
+		require.Nil(t, db.Close())
+
+		data, err := os.ReadFile(path)
+		require.Nil(t, err)
+		// the length of the second record now runs past the end
+		data[offsets[1]+5] ^= 1
+		require.Nil(t, os.WriteFile(path, data, 0644))
+		requireCorrupt(t, dir, path)
+	})
+
+	t.Run("frozen segment", func(t *testing.T) {
+		dir := t.TempDir()
+		db := openDatabase(t, dir, Options{})
+		require.Nil(t, db.Set("a", "value"))
+		path := db.current().readFile.Name()
+		db.initNewWritableSegment()
+		require.Nil(t, db.Set("b", "value"))
+		require.Nil(t, db.Close())
+
+		torn, err := encodeRecord(&DBRow{Key: "c", Value: "value"})
+		require.Nil(t, err)
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		require.Nil(t, err)
+		_, err = file.Write(torn[:len(torn)-3])
+		require.Nil(t, err)
+		require.Nil(t, file.Close())
+		requireCorrupt(t, dir, path)
+	})
+}
+
+func TestSegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	path := getFileAbsolutePath(dir, generateDataFileName())
+	ws, err := NewWritableSegment(path, SegmentHeader{IsCompacted: true, Sequence: 42}, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	require.Nil(t, ws.Write("a", "b"))
+	require.Nil(t, ws.Close())
+
+	seg, err := NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	require.Equal(t, SegmentHeader{Version: currentSegmentVersion, IsCompacted: true, Sequence: 42}, seg.GetHeader())
+	require.Nil(t, seg.RecoverIndex())
+	value, err := seg.Read("a")
+	require.Nil(t, err)
+	require.Equal(t, "b", value)
+	require.Nil(t, seg.Close())
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	header := SegmentHeader{Version: sstableSegmentVersion + 1}.encode()
+	copy(data, header)
+	require.Nil(t, os.WriteFile(path, data, 0644))
+	_, err = NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	require.ErrorContains(t, err, "unsupported segment format version")
+
+	// a damaged header isn't taken for a legacy segment and migrated away
+	header = SegmentHeader{Version: currentSegmentVersion, Sequence: 42}.encode()
+	header[headerSequenceOffset] ^= 0xff
+	copy(data, header)
+	require.Nil(t, os.WriteFile(path, data, 0644))
+	_, err = NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	require.ErrorIs(t, err, ErrCorruptSegmentHeader)
+	_, err = Open(dir, Options{})
+	require.ErrorIs(t, err, ErrCorruptSegmentHeader)
+	onDisk, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, data, onDisk)
+}
+
+func TestLegacySegmentIsMigrated(t *testing.T) {
+	dir := t.TempDir()
+	var legacy []byte
+	for i, key := range []string{"a", "b", "a"} {
+		payload, err := msgpack.Marshal(&DBRow{Key: key, CreationTime: 1, Value: fmt.Sprintf("v%d", i), Offset: formatOffset(int64(len(legacy)))})
+		require.Nil(t, err)
+		length := make([]byte, 8)
+		binary.LittleEndian.PutUint64(length, uint64(len(payload)))
+		legacy = append(legacy, length...)
+		legacy = append(legacy, payload...)
+	}
+	require.Nil(t, os.WriteFile(getFileAbsolutePath(dir, generateDataFileName()), legacy, 0644))
+
+	db := openDatabase(t, dir, Options{})
+	defer db.Close()
+	value, err := db.Get("a")
+	require.Nil(t, err)
+	require.Equal(t, "v2", value)
+	value, err = db.Get("b")
+	require.Nil(t, err)
+	require.Equal(t, "v1", value)
+}
+
+func TestRecoverIndexFromHintFile(t *testing.T) {
+	dir := t.TempDir()
+	path := getFileAbsolutePath(dir, generateDataFileName())
+	ws, err := NewWritableSegment(path, SegmentHeader{Sequence: 1}, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	require.Nil(t, ws.Write("a", "v1"))
+	require.Nil(t, ws.Write("b", "v2"))
+	require.Nil(t, ws.Write("a", "v3"))
+	require.Nil(t, ws.WriteHint())
+	require.Nil(t, ws.Close())
+
+	entries, _, err := readHintFile(path, ws.size())
+	require.Nil(t, err)
+	require.Len(t, entries, 3, "every version is listed")
+
+	recovered := func() index.Index {
+		seg, err := NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+		require.Nil(t, err)
+		defer seg.Close()
+		require.Nil(t, seg.RecoverIndex())
+		value, err := seg.Read("a")
+		require.Nil(t, err)
+		require.Equal(t, "v3", value)
+		return seg.GetIndexStrategy()
+	}
+	fromHint := recovered()
+
+	hint, err := os.ReadFile(hintFilePath(path))
+	require.Nil(t, err)
+	hint[len(hintMagic)+10] ^= 0xff
+	require.Nil(t, os.WriteFile(hintFilePath(path), hint, 0644))
+	_, _, err = readHintFile(path, ws.size())
+	require.ErrorIs(t, err, errInvalidHintFile)
+
+	fromScan := recovered()
+	for _, key := range []string{"a", "b"} {
+		hintRecord, err := fromHint.GetRecord(key)
+		require.Nil(t, err)
+		scanRecord, err := fromScan.GetRecord(key)
+		require.Nil(t, err)
+		require.Equal(t, scanRecord, hintRecord)
+		hintVersions, err := fromHint.GetVersions(key)
+		require.Nil(t, err)
+		scanVersions, err := fromScan.GetVersions(key)
+		require.Nil(t, err)
+		require.Equal(t, scanVersions, hintVersions)
+	}
+	_, _, err = readHintFile(path, ws.size())
+	require.Nil(t, err, "a full scan rewrites the hint file")
+	_, _, err = readHintFile(path, ws.size()+1)
+	require.ErrorIs(t, err, errInvalidHintFile)
+}
+
+func TestMissingKeyReturnsErrKeyNotFound(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	require.Nil(t, db.Set("x", "y"))
+	require.Nil(t, db.Close())
+
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	require.NotEmpty(t, db.frozenSegments.snapshot())
+	_, err := db.Get("missing")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	value, err := db.Get("x")
+	require.Nil(t, err)
+	require.Equal(t, "y", value)
+}
+
+func TestOpenReturnsErrors(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(getFileAbsolutePath(dir, generateDataFileName()), SegmentHeader{Version: sstableSegmentVersion + 1}.encode(), 0644))
+	_, err := Open(dir, Options{})
+	require.ErrorContains(t, err, "unsupported segment format version")
+
+	notADir := getFileAbsolutePath(t.TempDir(), "file")
+	require.Nil(t, os.WriteFile(notADir, nil, 0644))
+	_, err = Open(notADir, Options{})
+	require.NotNil(t, err)
+}
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	require.Nil(t, db.Set("stale", "value"))
+
+	batch := NewWriteBatch()
+	batch.Put("user/1", "serkan")
+	batch.Put("email/serkan@example.com", "user/1")
+	batch.Delete("stale")
+	require.Nil(t, db.Write(batch))
+	require.Nil(t, db.Close())
+
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	value, err := db.Get("user/1")
+	require.Nil(t, err)
+	require.Equal(t, "serkan", value)
+	value, err = db.Get("email/serkan@example.com")
+	require.Nil(t, err)
+	require.Equal(t, "user/1", value)
+	_, err = db.Get("stale")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+}
+
+func TestTornWriteBatchIsDroppedAsAWhole(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	require.Nil(t, db.Set("before", "batch"))
+	sizeBeforeBatch := db.current().size()
+	batch := NewWriteBatch()
+	batch.Put("a", "1")
+	batch.Put("b", "2")
+	require.Nil(t, db.Write(batch))
+	path := db.current().readFile.Name()
+	sizeAfterBatch := db.current().size()
+	require.Nil(t, db.Close())
+	require.Nil(t, os.Truncate(path, sizeAfterBatch-2))
+
+	seg, err := NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	seg.(*immutableSegment).mayBeTorn = true
+	require.Nil(t, seg.RecoverIndex())
+	require.Nil(t, seg.Close())
+	stat, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, sizeBeforeBatch, stat.Size(), "the whole batch is cut off")
+
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	value, err := db.Get("before")
+	require.Nil(t, err)
+	require.Equal(t, "batch", value)
+	for _, key := range []string{"a", "b"} {
+		_, err = db.Get(key)
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+	}
+}
+
+func TestTxnReadsFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	defer db.Close()
+	require.Nil(t, db.Set("balance", 100))
+	require.Nil(t, db.Set("removed", "value"))
+
+	txn := db.Begin()
+	defer txn.Rollback()
+	require.Nil(t, db.Set("balance", 50))
+	require.Nil(t, db.Delete("removed"))
+	require.Nil(t, db.Set("created", "value"))
+
+	value, err := txn.Get("balance")
+	require.Nil(t, err)
+	require.EqualValues(t, 100, value)
+	value, err = txn.Get("removed")
+	require.Nil(t, err)
+	require.Equal(t, "value", value)
+	_, err = txn.Get("created")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+
+	// own writes are visible before commit
+	require.Nil(t, txn.Set("balance", 10))
+	require.Nil(t, txn.Delete("removed"))
+	value, err = txn.Get("balance")
+	require.Nil(t, err)
+	require.EqualValues(t, 10, value)
+	_, err = txn.Get("removed")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+
+	// the snapshot outlives segment rotation and compaction
+	db.initNewWritableSegment()
+	require.Nil(t, db.frozenSegments.Compaction())
+	_, err = txn.Get("created")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	txn.Rollback()
+	_, err = txn.Get("balance")
+	require.ErrorIs(t, err, ErrTxnDone)
+
+	value, err = db.Get("balance")
+	require.Nil(t, err)
+	require.EqualValues(t, 50, value)
+}
+
+func TestTxnCommitDetectsConflicts(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	require.Nil(t, db.Set("counter", 1))
+
+	first, second := db.Begin(), db.Begin()
+	for _, txn := range []*Txn{first, second} {
+		value, err := txn.Get("counter")
+		require.Nil(t, err)
+		require.Nil(t, txn.Set("counter", value.(int8)+1))
+	}
+	require.Nil(t, first.Set("first", "committed"))
+	require.Nil(t, second.Set("second", "committed"))
+	require.Nil(t, first.Commit())
+	require.ErrorIs(t, second.Commit(), ErrConflict)
+	require.ErrorIs(t, second.Commit(), ErrTxnDone)
+
+	// a key created after the snapshot is a conflict too
+	txn := db.Begin()
+	_, err := txn.Get("later")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	require.Nil(t, txn.Set("later", "from txn"))
+	require.Nil(t, db.Set("later", "from db"))
+	require.ErrorIs(t, txn.Commit(), ErrConflict)
+
+	// blind writes don't conflict
+	txn = db.Begin()
+	require.Nil(t, txn.Set("counter", 10))
+	require.Nil(t, db.Set("counter", 5))
+	require.Nil(t, txn.Commit())
+	require.Nil(t, db.Close())
+
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	value, err := db.Get("counter")
+	require.Nil(t, err)
+	require.EqualValues(t, 10, value)
+	value, err = db.Get("first")
+	require.Nil(t, err)
+	require.Equal(t, "committed", value)
+	_, err = db.Get("second")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	value, err = db.Get("later")
+	require.Nil(t, err)
+	require.Equal(t, "from db", value)
+
+	// sequence numbers keep growing after a restart
+	txn = db.Begin()
+	_, err = txn.Get("counter")
+	require.Nil(t, err)
+	require.Nil(t, db.Set("counter", 11))
+	require.Nil(t, txn.Set("counter", 12))
+	require.ErrorIs(t, txn.Commit(), ErrConflict)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	require.ErrorIs(t, db.SetWithTTL("session", "value", 0), errInvalidTTL)
+
+	require.Nil(t, db.Set("user", "serkan"))
+	require.Nil(t, db.SetWithTTL("user", "session of serkan", 50*time.Millisecond))
+	require.Nil(t, db.SetWithTTL("session", "value", 50*time.Millisecond))
+	require.Nil(t, db.SetWithTTL("long-session", "value", time.Hour))
+	value, err := db.Get("session")
+	require.Nil(t, err)
+	require.Equal(t, "value", value)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get("session")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	// an expired value hides the older ones
+	_, err = db.Get("user")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	require.Nil(t, db.Close())
+
+	// reopening compacts the segment and drops the expired keys
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	segments := db.frozenSegments.snapshot()
+	require.Len(t, segments, 1)
+	require.ElementsMatch(t, []string{"long-session"}, segments[0].GetUniqueKeys())
+	value, err = db.Get("long-session")
+	require.Nil(t, err)
+	require.Equal(t, "value", value)
+	_, err = db.Get("user")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+
+	// an expired value compacted while an older segment still has the key
+	// is kept as a tombstone
+	require.Nil(t, db.Set("cart", "old"))
+	db.initNewWritableSegment()
+	require.Nil(t, db.SetWithTTL("cart", "new", 50*time.Millisecond))
+	db.initNewWritableSegment()
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, db.frozenSegments.Compaction())
+	_, err = db.Get("cart")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+}
+
+func TestSkipListIndex(t *testing.T) {
+	idx := index.NewSkipListIndex().(index.OrderedIndex)
+	for i, key := range []string{"b", "d", "a", "c", "e"} {
+		idx.Set(key, index.Record{Offset: formatOffset(int64(i)), Seq: uint64(i + 1)})
+	}
+	idx.Set("c", index.Record{Offset: formatOffset(10), Seq: 10})
+	idx.Delete("d")
+	idx.Delete("missing")
+
+	require.Equal(t, []string{"a", "b", "c", "e"}, idx.AllKeys())
+	require.Equal(t, []string{"b", "c"}, idx.KeysInRange("b", "d"))
+	require.Equal(t, []string{"c", "e"}, idx.KeysInRange("bb", ""))
+	offset, err := idx.Get("c")
+	require.Nil(t, err)
+	require.Equal(t, formatOffset(10), offset)
+	record, err := idx.GetRecordAt("c", 9)
+	require.Nil(t, err)
+	require.Equal(t, formatOffset(3), record.Offset)
+	_, err = idx.Get("d")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+}
+
+func TestScan(t *testing.T) {
+	for name, newIndex := range map[string]func() index.Index{
+		"hashmap":  index.NewHashMapIndex,
+		"skiplist": index.NewSkipListIndex,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := openDatabase(t, t.TempDir(), Options{IndexFactory: newIndex})
+			defer db.Close()
+			require.Nil(t, db.Set("user/1/orders/2", "old"))
+			require.Nil(t, db.Set("user/1/orders/3", "deleted later"))
+			require.Nil(t, db.Set("user/2/orders/1", "x"))
+			db.initNewWritableSegment()
+			require.Nil(t, db.Set("user/1/orders/1", "a"))
+			require.Nil(t, db.Set("user/1/orders/2", "b"))
+			require.Nil(t, db.Delete("user/1/orders/3"))
+			require.Nil(t, db.Set("user/10", "not a child of user/1/"))
+
+			it := db.ScanPrefix("user/1/")
+			// writes after the scan started aren't visible to it
+			require.Nil(t, db.Set("user/1/orders/4", "later"))
+			var keys, values []string
+			for it.Next() {
+				keys = append(keys, it.Key())
+				values = append(values, it.Value().(string))
+			}
+			require.Nil(t, it.Err())
+			require.Equal(t, []string{"user/1/orders/1", "user/1/orders/2"}, keys)
+			require.Equal(t, []string{"a", "b"}, values)
+
+			it = db.Scan("user/1/orders/2", "user/2")
+			keys = nil
+			for it.Next() {
+				keys = append(keys, it.Key())
+			}
+			require.Equal(t, []string{"user/1/orders/2", "user/1/orders/4", "user/10"}, keys)
+		})
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(10_000)
+	for i := 0; i < 10_000; i++ {
+		filter.Add("key-" + strconv.Itoa(i))
+	}
+	falsePositives := 0
+	for i := 0; i < 10_000; i++ {
+		require.True(t, filter.MayContain("key-"+strconv.Itoa(i)))
+		if filter.MayContain("absent-" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 200)
+}
+
+func TestFrozenSegmentsHaveBloomFilters(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	require.Nil(t, db.Set("present", "value"))
+	// garbage, so that reopening compacts the segment
+	require.Nil(t, db.Set("present", "value"))
+	db.initNewWritableSegment()
+	segments := db.frozenSegments.snapshot()
+	require.Len(t, segments, 1)
+	path := getFileAbsolutePath(dir, segments[0].GetId())
+	_, err := os.Stat(bloomFilePath(path))
+	require.Nil(t, err)
+	require.False(t, segments[0].(*immutableSegment).mayContain("absent"))
+	require.Nil(t, db.Close())
+
+	// a stale bloom file is rebuilt on recovery, compaction builds its own
+	require.Nil(t, os.WriteFile(bloomFilePath(path), []byte("garbage"), 0644))
+	seg, err := NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	require.Nil(t, seg.RecoverIndex())
+	_, err = readBloomFile(path, seg.(*immutableSegment).size())
+	require.Nil(t, err)
+	require.Nil(t, seg.Close())
+
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	_, err = os.Stat(bloomFilePath(path))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	for _, seg := range db.frozenSegments.snapshot() {
+		// the empty segment left by the first run has no garbage to compact
+		require.Equal(t, len(seg.GetUniqueKeys()) > 0, seg.GetHeader().IsCompacted)
+		_, err = os.Stat(bloomFilePath(getFileAbsolutePath(dir, seg.GetId())))
+		require.Nil(t, err)
+	}
+	value, err := db.Get("present")
+	require.Nil(t, err)
+	require.Equal(t, "value", value)
+	_, err = db.Get("absent")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+}
+
+func TestSSTable(t *testing.T) {
+	dir := t.TempDir()
+	path := getFileAbsolutePath(dir, generateDataFileName())
+	writer, err := newSSTableWriter(path, SegmentHeader{IsCompacted: true, Sequence: 7})
+	require.Nil(t, err)
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("user/%04d/orders", i))
+	}
+	for i, key := range keys {
+		require.Nil(t, writer.add(DBRow{Key: key, Value: "old", Seq: uint64(2*i + 1)}))
+		require.Nil(t, writer.add(DBRow{Key: key, Value: "new", Seq: uint64(2*i + 2)}))
+	}
+	require.ErrorIs(t, writer.add(DBRow{Key: "a", Seq: 1}), errSSTableOutOfOrder)
+	require.Nil(t, writer.finish())
+
+	seg, err := NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	defer seg.Close()
+	require.Nil(t, seg.RecoverIndex())
+	require.True(t, seg.GetHeader().IsSorted())
+	require.Equal(t, uint64(2000), seg.MaxSeq())
+	table := seg.GetIndexStrategy().(*sstableIndex)
+	require.Greater(t, len(table.blocks), 1)
+	// keys share most of their bytes with the previous one
+	require.Less(t, table.blocks[1].offset-table.blocks[0].offset, int64(sstableBlockSize+len(keys[0])*4))
+
+	for i, key := range keys {
+		value, err := seg.Read(key)
+		require.Nil(t, err)
+		require.Equal(t, "new", value)
+		row, err := seg.ReadRowAt(key, uint64(2*i+1))
+		require.Nil(t, err)
+		require.Equal(t, "old", row.Value)
+	}
+	_, err = seg.Read("user/0500")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	_, err = seg.Read("zzz")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	require.Equal(t, keys, seg.GetUniqueKeys())
+	require.Equal(t, keys[10:20], table.KeysInRange(keys[10], keys[20]))
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	data[len(data)-sstableFooterSize-1] ^= 0xff
+	require.Nil(t, os.WriteFile(path, data, 0644))
+	_, err = NewImmutableSegment(path, index.NewHashMapIndex(), log.Default())
+	var corruptErr *ErrCorruptRecord
+	require.ErrorAs(t, err, &corruptErr)
+}
+
+func TestLSMStorage(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Storage: LSMStorage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 2}}
+	db := openDatabase(t, dir, opts)
+	for i := 0; i < 100; i++ {
+		require.Nil(t, db.Set(fmt.Sprintf("key-%03d", i), i))
+	}
+	db.initNewWritableSegment()
+	for i := 0; i < 100; i += 2 {
+		require.Nil(t, db.Delete(fmt.Sprintf("key-%03d", i)))
+	}
+	require.Nil(t, db.Set("key-001", "updated"))
+	db.initNewWritableSegment()
+
+	// waits for the merge the flushes started in the background
+	require.Nil(t, db.frozenSegments.Merge())
+	segments := db.frozenSegments.snapshot()
+	require.Len(t, segments, 1)
+	require.True(t, segments[0].GetHeader().IsSorted())
+	require.Nil(t, db.Close())
+
+	db = openDatabase(t, dir, opts)
+	defer db.Close()
+	value, err := db.Get("key-001")
+	require.Nil(t, err)
+	require.Equal(t, "updated", value)
+	value, err = db.Get("key-003")
+	require.Nil(t, err)
+	require.EqualValues(t, 3, value)
+	_, err = db.Get("key-002")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+
+	var keys []string
+	for it := db.ScanPrefix("key-09"); it.Next(); {
+		keys = append(keys, it.Key())
+	}
+	require.Equal(t, []string{"key-091", "key-093", "key-095", "key-097", "key-099"}, keys)
+}
+
+func TestSizeTieredStrategy(t *testing.T) {
+	segment := func(id string, size int64) SegmentInfo {
+		return SegmentInfo{Id: id, IsCompacted: true, Size: size, KeyCount: 1}
+	}
+	strategy := NewSizeTieredStrategy()
+	segments := []SegmentInfo{segment("big", 4000), segment("a", 1000), segment("b", 1100), segment("c", 900)}
+	require.Empty(t, strategy.Plan(segments))
+
+	// segments join a run whether they were compacted or not
+	segments = append(segments, SegmentInfo{Id: "f", Size: 1200, KeyCount: 1}, segment("small", 10))
+	tasks := strategy.Plan(segments)
+	require.Len(t, tasks, 1)
+	var ids []string
+	for _, input := range tasks[0].Inputs {
+		ids = append(ids, input.Id)
+	}
+	require.Equal(t, []string{"a", "b", "c", "f"}, ids)
+	require.Empty(t, strategy.Plan(segments[:4]))
+
+	dirty := segment("dirty", 100)
+	dirty.GarbageRatio = 0.8
+	tasks = strategy.Plan([]SegmentInfo{segment("a", 1000), dirty})
+	require.Len(t, tasks, 1)
+	require.Equal(t, []SegmentInfo{dirty}, tasks[0].Inputs)
+
+	// the garbage threshold comes from the options
+	opts := Options{CompactionStrategy: strategy, GarbageThreshold: 0.9}.withDefaults()
+	require.Empty(t, opts.CompactionStrategy.Plan([]SegmentInfo{segment("a", 1000), dirty}))
+	require.Len(t, strategy.Plan([]SegmentInfo{segment("a", 1000), dirty}), 1)
+}
+
+func TestLeveledStrategy(t *testing.T) {
+	segment := func(id string, level int, size int64, minKey, maxKey string) SegmentInfo {
+		return SegmentInfo{Id: id, Level: level, IsCompacted: true, Size: size, KeyCount: 2, MinKey: minKey, MaxKey: maxKey}
+	}
+	strategy := &LeveledStrategy{L0Trigger: 2, BaseLevelSize: 1000, TargetSegmentSize: 100, MaxLevel: 3}
+	l1 := []SegmentInfo{segment("l1-a", 1, 100, "a", "c"), segment("l1-d", 1, 100, "d", "f"), segment("l1-g", 1, 100, "g", "i")}
+	l0 := []SegmentInfo{segment("l0-1", 0, 50, "b", "b"), segment("l0-2", 0, 50, "e", "e")}
+	tasks := strategy.Plan(append(append([]SegmentInfo{}, l1...), l0...))
+	require.Len(t, tasks, 1)
+	require.Equal(t, 1, tasks[0].OutputLevel)
+	require.Equal(t, int64(100), tasks[0].SplitSize)
+	require.ElementsMatch(t, []SegmentInfo{l0[0], l0[1], l1[0], l1[1]}, tasks[0].Inputs)
+
+	require.Empty(t, strategy.Plan(append(append([]SegmentInfo{}, l1...), l0[0])))
+
+	// an oversized level pushes its dirtiest segment down
+	big := []SegmentInfo{segment("l1-x", 1, 600, "a", "m"), segment("l1-y", 1, 600, "n", "z")}
+	big[1].GarbageRatio = 0.3
+	l2 := segment("l2", 2, 100, "p", "q")
+	tasks = strategy.Plan([]SegmentInfo{l2, big[0], big[1]})
+	require.Len(t, tasks, 1)
+	require.Equal(t, 2, tasks[0].OutputLevel)
+	require.Equal(t, []SegmentInfo{big[1], l2}, tasks[0].Inputs)
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		Storage:            LSMStorage,
+		CompactionStrategy: &LeveledStrategy{L0Trigger: 2, BaseLevelSize: 1 << 20, TargetSegmentSize: 4096},
+	}
+	db := openDatabase(t, dir, opts)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 200; i++ {
+			require.Nil(t, db.Set(fmt.Sprintf("key-%03d", i), round))
+		}
+		db.initNewWritableSegment()
+		require.Nil(t, db.frozenSegments.Merge())
+	}
+	require.Nil(t, db.Close())
+
+	db = openDatabase(t, dir, opts)
+	defer db.Close()
+	var level1 []SegmentInfo
+	for _, seg := range db.frozenSegments.snapshot() {
+		if info := segmentInfo(seg); info.Level == 1 {
+			level1 = append(level1, info)
+		}
+	}
+	require.Greater(t, len(level1), 1)
+	for i := 1; i < len(level1); i++ {
+		for _, other := range level1[:i] {
+			require.False(t, level1[i].overlaps(other))
+		}
+	}
+	for i := 0; i < 200; i++ {
+		value, err := db.Get(fmt.Sprintf("key-%03d", i))
+		require.Nil(t, err)
+		require.EqualValues(t, 3, value)
+	}
+}
+
+// planCounter counts the merges a strategy plans.
+type planCounter struct {
+	CompactionStrategy
+	tasks int
+}
+
+func (p *planCounter) Plan(segments []SegmentInfo) []CompactionTask {
+	tasks := p.CompactionStrategy.Plan(segments)
+	p.tasks += len(tasks)
+	return tasks
+}
+
+func TestMergeStopsWithoutProgress(t *testing.T) {
+	strategy := &planCounter{CompactionStrategy: NewSizeTieredStrategy()}
+	db := openDatabase(t, t.TempDir(), Options{CompactionStrategy: strategy})
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		require.Nil(t, db.Set(fmt.Sprintf("key-%02d", i), "value"))
+	}
+	db.initNewWritableSegment()
+	for i := 0; i < 50; i++ {
+		require.Nil(t, db.Delete(fmt.Sprintf("key-%02d", i)))
+	}
+	db.initNewWritableSegment()
+	// only a merge of both segments drops the deleted versions
+	require.Nil(t, db.frozenSegments.Merge())
+	require.Zero(t, strategy.tasks)
+
+	// every rewrite keeps the versions an open snapshot reads
+	snapshot := db.acquireSnapshot()
+	defer db.releaseSnapshot(snapshot)
+	for i := 0; i < 50; i++ {
+		require.Nil(t, db.Set(fmt.Sprintf("key-%02d", i), "old"))
+		require.Nil(t, db.Set(fmt.Sprintf("key-%02d", i), "new"))
+	}
+	db.initNewWritableSegment()
+	require.Nil(t, db.frozenSegments.Merge())
+	require.LessOrEqual(t, strategy.tasks, 2)
+	value, err := db.Get("key-00")
+	require.Nil(t, err)
+	require.Equal(t, "new", value)
+}
+
+func TestRemovedSegmentsAreClosed(t *testing.T) {
+	db := openDatabase(t, t.TempDir(), Options{CompactionStrategy: &SizeTieredStrategy{MinThreshold: 100}})
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		require.Nil(t, db.Set("a", i))
+	}
+	old := db.current()
+	db.initNewWritableSegment()
+	segments := db.frozenSegments.snapshot()
+	require.Len(t, segments, 1)
+	frozen := segments[0].(*immutableSegment)
+
+	require.Nil(t, db.frozenSegments.Compaction())
+	require.NotContains(t, db.frozenSegments.snapshot(), Segment(frozen))
+	// the snapshot still reads the files of the replaced segment
+	row, err := frozen.ReadRowAt("a", math.MaxUint64)
+	require.Nil(t, err)
+	require.EqualValues(t, 4, row.Value)
+
+	releaseSegments(segments, db.opts.Logger)
+	_, err = frozen.readFile.Stat()
+	require.ErrorIs(t, err, os.ErrClosed)
+	_, err = old.wFile.Stat()
+	require.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestBackgroundMergesDontOverlap(t *testing.T) {
+	db := openDatabase(t, t.TempDir(), Options{})
+	defer db.Close()
+	require.True(t, db.frozenSegments.claimMerge())
+	// a merge is already claimed, a new segment doesn't schedule another one
+	require.False(t, db.frozenSegments.claimMerge())
+	require.Nil(t, db.frozenSegments.runClaimedMerge())
+	require.True(t, db.frozenSegments.claimMerge())
+	require.Nil(t, db.frozenSegments.runClaimedMerge())
+}
+
+func TestCloseWaitsForBackgroundWork(t *testing.T) {
+	db := openDatabase(t, t.TempDir(), Options{SegmentSize: 1024})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// writes keep starting size checks while Close waits for them
+			for j := 0; j < 200; j++ {
+				db.Set(fmt.Sprintf("key-%d-%d", i, j), j)
+			}
+		}(i)
+	}
+	require.Nil(t, db.Close())
+	wg.Wait()
+	require.False(t, db.goInBackground(func() { t.Error("ran after Close") }))
+}
+
+func TestSegmentStats(t *testing.T) {
+	dir := t.TempDir()
+	// merges would rewrite the segments too
+	strategy := &SizeTieredStrategy{MinThreshold: 100}
+	db := openDatabase(t, dir, Options{CompactionStrategy: strategy})
+	require.Nil(t, db.Set("a", "value"))
+	require.Nil(t, db.Set("b", "value"))
+	require.Nil(t, db.Set("c", "value"))
+	require.Nil(t, db.Set("a", "value"))
+	require.Nil(t, db.Delete("b"))
+	require.Nil(t, db.SetWithTTL("d", "value", 50*time.Millisecond))
+	stats := db.SegmentStats()
+	require.Len(t, stats, 1)
+	require.True(t, stats[0].Current)
+	require.EqualValues(t, 3, stats[0].LiveKeys)
+	require.EqualValues(t, 3, stats[0].DeadKeys)
+
+	// a write to the new segment supersedes the frozen version
+	db.initNewWritableSegment()
+	require.Nil(t, db.Set("c", "value"))
+	time.Sleep(100 * time.Millisecond)
+	stats = db.SegmentStats()
+	require.Len(t, stats, 2)
+	frozen := stats[0]
+	require.EqualValues(t, 1, frozen.LiveKeys)
+	require.EqualValues(t, 5, frozen.DeadKeys)
+	seg := db.frozenSegments.snapshot()[0].(*immutableSegment)
+	require.Equal(t, seg.size()-headerLength, frozen.LiveBytes+frozen.DeadBytes)
+	require.Nil(t, db.Close())
+
+	// recovery counts the same bytes
+	db = openDatabase(t, dir, Options{CompactionStrategy: strategy, GarbageThreshold: 0.99})
+	stats = db.SegmentStats()
+	require.Len(t, stats, 3)
+	require.False(t, stats[0].IsCompacted)
+	require.Equal(t, frozen.LiveBytes, stats[0].LiveBytes)
+	require.Equal(t, frozen.DeadBytes, stats[0].DeadBytes)
+	require.EqualValues(t, 1, stats[1].LiveKeys)
+	require.Zero(t, stats[1].GarbageRatio())
+	require.Nil(t, db.Close())
+
+	// only the segment above the threshold is compacted
+	db = openDatabase(t, dir, Options{CompactionStrategy: strategy})
+	defer db.Close()
+	segments := db.frozenSegments.snapshot()
+	require.Len(t, segments, 3)
+	require.True(t, segments[0].GetHeader().IsCompacted)
+	// the tombstone of b has nothing older left to hide
+	require.ElementsMatch(t, []string{"a", "c"}, segments[0].GetUniqueKeys())
+	for _, seg := range segments[1:] {
+		require.False(t, seg.GetHeader().IsCompacted)
+	}
+	value, err := db.Get("a")
+	require.Nil(t, err)
+	require.Equal(t, "value", value)
+}
+
+func TestShadowedGarbage(t *testing.T) {
+	dir := t.TempDir()
+	strategy := &SizeTieredStrategy{MinThreshold: 100}
+	db := openDatabase(t, dir, Options{CompactionStrategy: strategy})
+	for i := 0; i < 10; i++ {
+		require.Nil(t, db.Set(fmt.Sprintf("key-%d", i), "value"))
+		require.Nil(t, db.Set(fmt.Sprintf("other-%d", i), "value"))
+	}
+	db.initNewWritableSegment()
+	for i := 0; i < 10; i++ {
+		require.Nil(t, db.Set(fmt.Sprintf("key-%d", i), "again"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	stats := db.SegmentStats()
+	require.EqualValues(t, 10, stats[0].DeadKeys)
+	require.EqualValues(t, 10, stats[0].ShadowedKeys)
+	require.Less(t, stats[0].ReclaimableRatio(), 0.1)
+	// a rewrite of the segment alone would keep every version
+	require.Nil(t, db.frozenSegments.Compaction())
+	require.False(t, db.frozenSegments.snapshot()[0].GetHeader().IsCompacted)
+
+	// the versions a range tombstone deletes are shadowed until it's frozen
+	require.Nil(t, db.DeletePrefix("other-"))
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 20, db.SegmentStats()[0].ShadowedKeys)
+	db.initNewWritableSegment()
+	stats = db.SegmentStats()
+	require.EqualValues(t, 20, stats[0].DeadKeys)
+	require.EqualValues(t, 10, stats[0].ShadowedKeys)
+	require.Nil(t, db.Close())
+
+	// recovery counts them the same way
+	db = openDatabase(t, dir, Options{CompactionStrategy: strategy})
+	defer db.Close()
+	recovered := db.SegmentStats()
+	require.Equal(t, stats[0].ShadowedKeys, recovered[0].ShadowedKeys)
+	require.Equal(t, stats[0].ShadowedBytes, recovered[0].ShadowedBytes)
+	// the range tombstone still deletes the versions of the older segment
+	require.Zero(t, recovered[1].ShadowedKeys)
+	require.NotZero(t, recovered[1].ShadowedBytes)
+
+	// a tombstone hides the older versions until its key is written again
+	require.Nil(t, db.Delete("key-0"))
+	stats = db.SegmentStats()
+	require.EqualValues(t, 1, stats[len(stats)-1].ShadowedKeys)
+	require.Nil(t, db.Set("key-0", "value"))
+	stats = db.SegmentStats()
+	require.Zero(t, stats[len(stats)-1].ShadowedKeys)
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{})
+	require.Nil(t, db.Set("a", "old"))
+	require.Nil(t, db.Set("a", "new"))
+	db.initNewWritableSegment()
+	require.Nil(t, db.Set("b", "value"))
+	require.Nil(t, db.frozenSegments.Compaction())
+	var live []string
+	for _, seg := range db.frozenSegments.snapshot() {
+		live = append(live, seg.GetId())
+	}
+	live = append(live, db.current().GetId())
+	require.Nil(t, db.Close())
+
+	m, err := openManifest(dir, log.Default())
+	require.Nil(t, err)
+	require.ElementsMatch(t, live, m.liveIds())
+	require.Nil(t, m.Close())
+
+	// a compaction that crashed before its manifest edit left its output
+	// behind, one that crashed after it left its input
+	orphan := getFileAbsolutePath(dir, generateDataFileName())
+	ws, err := NewWritableSegment(orphan, SegmentHeader{Sequence: 99}, index.NewHashMapIndex(), log.Default())
+	require.Nil(t, err)
+	require.Nil(t, ws.Write("a", "stale"))
+	require.Nil(t, ws.WriteHint())
+	require.Nil(t, ws.Close())
+	require.Nil(t, os.WriteFile(orphan+".compact", nil, 0644))
+	require.Nil(t, os.WriteFile(manifestPath(dir)+".tmp", nil, 0644))
+	// and an edit torn by a crash is dropped
+	file, err := os.OpenFile(manifestPath(dir), os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, err)
+	torn := manifestEdit{added: []string{filepath.Base(orphan)}}.encode()
+	_, err = file.Write(torn[:len(torn)-1])
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	db = openDatabase(t, dir, Options{})
+	for _, path := range []string{orphan, hintFilePath(orphan), orphan + ".compact", manifestPath(dir) + ".tmp"} {
+		_, err = os.Stat(path)
+		require.ErrorIs(t, err, fs.ErrNotExist, path)
+	}
+	value, err := db.Get("a")
+	require.Nil(t, err)
+	require.Equal(t, "new", value)
+	require.Nil(t, db.Close())
+
+	// a live segment that's missing is an error rather than lost data
+	require.Nil(t, os.Remove(getFileAbsolutePath(dir, live[len(live)-1])))
+	_, err = Open(dir, Options{})
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// without a manifest the segment files found are live
+	require.Nil(t, os.Remove(manifestPath(dir)))
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	value, err = db.Get("a")
+	require.Nil(t, err)
+	require.Equal(t, "new", value)
+	_, err = os.Stat(manifestPath(dir))
+	require.Nil(t, err)
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	dir := t.TempDir()
+	db := openDatabase(t, dir, Options{CompactionStrategy: &SizeTieredStrategy{MinThreshold: 2}})
+	require.Nil(t, db.Set("key", "first"))
+	require.Nil(t, db.Set("key", "second"))
+	db.initNewWritableSegment()
+	require.Nil(t, db.Set("key", "third"))
+	before, err := db.lookup("key", math.MaxUint64)
+	require.Nil(t, err)
+	db.initNewWritableSegment()
+	require.Nil(t, db.frozenSegments.Merge())
+	require.Len(t, db.frozenSegments.snapshot(), 1)
+
+	// a merge keeps the sequence numbers and creation times of the rows
+	after, err := db.lookup("key", math.MaxUint64)
+	require.Nil(t, err)
+	require.Equal(t, "third", after.Value)
+	require.Equal(t, before.Seq, after.Seq)
+	require.Equal(t, before.CreationTime, after.CreationTime)
+	require.EqualValues(t, 3, after.Seq)
+	require.Nil(t, db.Close())
+
+	// the sequence numbers of dropped versions aren't handed out again
+	dir = t.TempDir()
+	db = openDatabase(t, dir, Options{})
+	require.Nil(t, db.SetWithTTL("session", "value", 50*time.Millisecond))
+	db.initNewWritableSegment()
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, db.frozenSegments.Compaction())
+	for _, seg := range db.frozenSegments.snapshot() {
+		require.Zero(t, seg.MaxSeq())
+	}
+	require.Nil(t, db.Close())
+	db = openDatabase(t, dir, Options{})
+	defer db.Close()
+	require.EqualValues(t, 1, db.lastSeq)
+	require.Nil(t, db.Set("key", "value"))
+	row, err := db.lookup("key", math.MaxUint64)
+	require.Nil(t, err)
+	require.EqualValues(t, 2, row.Seq)
+
+	// versions are ordered by sequence number whatever order they're set in
+	idx := index.NewHashMapIndex()
+	idx.Set("key", index.Record{Offset: "b", Seq: 7})
+	idx.Set("key", index.Record{Offset: "a", Seq: 3})
+	record, err := idx.GetRecord("key")
+	require.Nil(t, err)
+	require.Equal(t, "b", record.Offset)
+	record, err = idx.GetRecordAt("key", 5)
+	require.Nil(t, err)
+	require.Equal(t, "a", record.Offset)
+}
+
+func TestTombstones(t *testing.T) {
+	requireDeleted := func(t *testing.T, db *Database, key string) {
+		t.Helper()
+		_, err := db.Get(key)
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+	}
+	// holdsKey reports whether any frozen segment still has a version of key
+	holdsKey := func(db *Database, key string) bool {
+		for _, seg := range db.frozenSegments.snapshot() {
+			if _, err := seg.GetIndexStrategy().GetRecord(key); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	for name, storage := range map[string]StorageMode{"log": LogStorage, "lsm": LSMStorage} {
+		opts := Options{Storage: storage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 100}}
+		t.Run(name, func(t *testing.T) {
+			t.Run("delete in a newer segment survives compaction", func(t *testing.T) {
+				dir := t.TempDir()
+				db := openDatabase(t, dir, opts)
+				require.Nil(t, db.Set("key", "value"))
+				require.Nil(t, db.Set("other", "value"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.Delete("key"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Compaction())
+				requireDeleted(t, db, "key")
+				require.True(t, holdsKey(db, "key"), "the tombstone is kept while the older value exists")
+				require.Nil(t, db.Close())
+
+				// a scan recovers the tombstone as well
+				for _, seg := range db.frozenSegments.snapshot() {
+					os.Remove(hintFilePath(getFileAbsolutePath(dir, seg.GetId())))
+				}
+				db = openDatabase(t, dir, opts)
+				defer db.Close()
+				requireDeleted(t, db, "key")
+				value, err := db.Get("other")
+				require.Nil(t, err)
+				require.Equal(t, "value", value)
+			})
+
+			t.Run("merging the older segment drops the tombstone", func(t *testing.T) {
+				db := openDatabase(t, t.TempDir(), Options{Storage: storage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 2}})
+				defer db.Close()
+				require.Nil(t, db.Set("key", "value"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.Delete("key"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Merge())
+				requireDeleted(t, db, "key")
+				require.False(t, holdsKey(db, "key"))
+			})
+
+			t.Run("delete across rotations and merges", func(t *testing.T) {
+				dir := t.TempDir()
+				db := openDatabase(t, dir, opts)
+				for round := 0; round < 3; round++ {
+					for i := 0; i < 20; i++ {
+						require.Nil(t, db.Set(fmt.Sprintf("key-%02d", i), round))
+					}
+					db.initNewWritableSegment()
+				}
+				for i := 0; i < 20; i += 2 {
+					require.Nil(t, db.Delete(fmt.Sprintf("key-%02d", i)))
+				}
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Compaction())
+				db.frozenSegments.strategy = &SizeTieredStrategy{MinThreshold: 2, BucketLow: 0.01, BucketHigh: 100}
+				require.Nil(t, db.frozenSegments.Merge())
+				require.Nil(t, db.Close())
+
+				db = openDatabase(t, dir, opts)
+				defer db.Close()
+				for i := 0; i < 20; i++ {
+					key := fmt.Sprintf("key-%02d", i)
+					if i%2 == 0 {
+						requireDeleted(t, db, key)
+						continue
+					}
+					value, err := db.Get(key)
+					require.Nil(t, err)
+					require.EqualValues(t, 2, value)
+				}
+			})
+
+			t.Run("set after delete", func(t *testing.T) {
+				db := openDatabase(t, t.TempDir(), opts)
+				defer db.Close()
+				require.Nil(t, db.Set("key", "first"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.Delete("key"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.Set("key", "second"))
+				require.Nil(t, db.frozenSegments.Compaction())
+				value, err := db.Get("key")
+				require.Nil(t, err)
+				require.Equal(t, "second", value)
+			})
+		})
+	}
+
+	t.Run("batches and transactions write tombstones", func(t *testing.T) {
+		db := openDatabase(t, t.TempDir(), Options{})
+		defer db.Close()
+		require.Nil(t, db.Set("batch", "value"))
+		require.Nil(t, db.Set("txn", "value"))
+		batch := NewWriteBatch()
+		batch.Delete("batch")
+		require.Nil(t, db.Write(batch))
+		txn := db.Begin()
+		require.Nil(t, txn.Set("txn", "changed"))
+		require.Nil(t, txn.Delete("txn"))
+		require.Nil(t, txn.Commit())
+		for _, key := range []string{"batch", "txn"} {
+			row, err := db.lookup(key, math.MaxUint64)
+			require.Nil(t, err)
+			require.Equal(t, RecordTypeTombstone, row.Type)
+			requireDeleted(t, db, key)
+		}
+	})
+
+	t.Run("legacy tombstones are still deletions", func(t *testing.T) {
+		row := DBRow{Key: "key", Value: legacyTombstoneValue}
+		require.True(t, row.isTombstone())
+		row.Type = RecordTypeBatch
+		require.False(t, row.isTombstone())
+	})
+}
+
+func TestRangeTombstones(t *testing.T) {
+	requireKeys := func(t *testing.T, db *Database, prefix string, expected ...string) {
+		t.Helper()
+		it := db.ScanPrefix(prefix)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		require.Nil(t, it.Err())
+		require.Equal(t, expected, keys)
+	}
+	// rangeTombstoneCount counts the range tombstones of the frozen segments
+	rangeTombstoneCount := func(db *Database) int {
+		count := 0
+		for _, seg := range db.frozenSegments.snapshot() {
+			count += len(seg.(*immutableSegment).ranges.all())
+		}
+		return count
+	}
+	for name, storage := range map[string]StorageMode{"log": LogStorage, "lsm": LSMStorage} {
+		opts := Options{Storage: storage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 100}}
+		t.Run(name, func(t *testing.T) {
+			t.Run("delete prefix hides older segments and survives reopening", func(t *testing.T) {
+				dir := t.TempDir()
+				db := openDatabase(t, dir, opts)
+				for _, key := range []string{"user/1", "user/2", "users", "video/1"} {
+					require.Nil(t, db.Set(key, "old"))
+				}
+				db.initNewWritableSegment()
+				require.Nil(t, db.Set("user/3", "old"))
+				require.Nil(t, db.DeletePrefix("user/"))
+				require.Nil(t, db.Set("user/2", "new"))
+				requireKeys(t, db, "user", "user/2", "users")
+				_, err := db.Get("user/1")
+				require.ErrorIs(t, err, index.ErrKeyNotFound)
+
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Compaction())
+				require.Equal(t, 1, rangeTombstoneCount(db), "the range tombstone is kept while the older values exist")
+				requireKeys(t, db, "user", "user/2", "users")
+				require.Nil(t, db.Close())
+
+				// a scan recovers the range tombstone as well
+				for _, seg := range db.frozenSegments.snapshot() {
+					os.Remove(hintFilePath(getFileAbsolutePath(dir, seg.GetId())))
+				}
+				for _, reopened := range []string{"scan", "hint"} {
+					db = openDatabase(t, dir, opts)
+					requireKeys(t, db, "", "user/2", "users", "video/1")
+					value, err := db.Get("user/2")
+					require.Nil(t, err, reopened)
+					require.Equal(t, "new", value)
+					require.Nil(t, db.Close())
+				}
+			})
+
+			t.Run("merging drops the deleted versions and the range tombstone", func(t *testing.T) {
+				db := openDatabase(t, t.TempDir(), Options{Storage: storage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 2}})
+				defer db.Close()
+				for i := 0; i < 10; i++ {
+					require.Nil(t, db.Set(fmt.Sprintf("key-%d", i), i))
+				}
+				db.initNewWritableSegment()
+				require.Nil(t, db.DeleteRange("key-2", "key-7"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Merge())
+				require.Zero(t, rangeTombstoneCount(db))
+				requireKeys(t, db, "key-", "key-0", "key-1", "key-7", "key-8", "key-9")
+				for _, seg := range db.frozenSegments.snapshot() {
+					keys, err := segmentKeysInRange(seg, "", "")
+					require.Nil(t, err)
+					require.Equal(t, []string{"key-0", "key-1", "key-7", "key-8", "key-9"}, keys)
+				}
+			})
+
+			t.Run("snapshots keep reading deleted versions", func(t *testing.T) {
+				db := openDatabase(t, t.TempDir(), Options{Storage: storage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 2}})
+				defer db.Close()
+				require.Nil(t, db.Set("a", "value"))
+				require.Nil(t, db.Set("b", "value"))
+				db.initNewWritableSegment()
+				txn := db.Begin()
+				defer txn.Rollback()
+				require.Nil(t, db.DeleteRange("", ""))
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Merge())
+				value, err := txn.Get("a")
+				require.Nil(t, err)
+				require.Equal(t, "value", value)
+				requireKeys(t, db, "")
+			})
+		})
+	}
+
+	t.Run("empty ranges are rejected", func(t *testing.T) {
+		db := openDatabase(t, t.TempDir(), Options{})
+		defer db.Close()
+		require.ErrorIs(t, db.DeleteRange("b", "a"), errInvalidRange)
+		require.ErrorIs(t, db.DeleteRange("a", "a"), errInvalidRange)
+	})
+
+	t.Run("range deletes count as garbage", func(t *testing.T) {
+		db := openDatabase(t, t.TempDir(), Options{})
+		defer db.Close()
+		require.Nil(t, db.Set("key-1", "value"))
+		db.initNewWritableSegment()
+		require.Nil(t, db.Set("key-2", "value"))
+		require.Nil(t, db.DeletePrefix("key-"))
+		require.Nil(t, db.Set("key-2", "again"))
+		// the deleted versions are counted in the background
+		time.Sleep(100 * time.Millisecond)
+		stats := db.SegmentStats()
+		require.EqualValues(t, 0, stats[len(stats)-2].LiveKeys)
+		require.EqualValues(t, 1, stats[len(stats)-1].LiveKeys)
+		require.EqualValues(t, 1, stats[len(stats)-1].DeadKeys)
+	})
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := openDatabase(t, t.TempDir(), Options{})
+	defer db.Close()
+
+	version, err := db.SetIfNotExists("lock", "worker-1")
+	require.Nil(t, err)
+	_, err = db.SetIfNotExists("lock", "worker-2")
+	require.ErrorIs(t, err, ErrVersionMismatch)
+	value, current, err := db.GetWithVersion("lock")
+	require.Nil(t, err)
+	require.Equal(t, "worker-1", value)
+	require.Equal(t, version, current)
+
+	_, err = db.CompareAndSwap("lock", version+1, "worker-2")
+	require.ErrorIs(t, err, ErrVersionMismatch)
+	swapped, err := db.CompareAndSwap("lock", version, "worker-2")
+	require.Nil(t, err)
+	require.Greater(t, swapped, version)
+
+	// versions survive the segment being frozen and compacted
+	db.initNewWritableSegment()
+	require.Nil(t, db.frozenSegments.Compaction())
+	_, current, err = db.GetWithVersion("lock")
+	require.Nil(t, err)
+	require.Equal(t, swapped, current)
+
+	require.ErrorIs(t, db.DeleteIfVersion("lock", version), ErrVersionMismatch)
+	require.Nil(t, db.DeleteIfVersion("lock", swapped))
+	_, _, err = db.GetWithVersion("lock")
+	require.ErrorIs(t, err, index.ErrKeyNotFound)
+	_, err = db.SetIfNotExists("lock", "worker-3")
+	require.Nil(t, err, "a deleted key can be claimed again")
+
+	t.Run("only one concurrent claim wins", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var wins int32
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := db.SetIfNotExists("job", i); err == nil {
+					atomic.AddInt32(&wins, 1)
+				} else {
+					require.ErrorIs(t, err, ErrVersionMismatch)
+				}
+			}(i)
+		}
+		wg.Wait()
+		require.EqualValues(t, 1, wins)
+	})
+}
+
+func TestHistory(t *testing.T) {
+	values := func(versions []Version) []interface{} {
+		var values []interface{}
+		for _, version := range versions {
+			if version.Deleted {
+				values = append(values, nil)
+				continue
+			}
+			values = append(values, version.Value)
+		}
+		return values
+	}
+	for name, storage := range map[string]StorageMode{"log": LogStorage, "lsm": LSMStorage} {
+		t.Run(name, func(t *testing.T) {
+			t.Run("compaction keeps only the newest version by default", func(t *testing.T) {
+				db := openDatabase(t, t.TempDir(), Options{Storage: storage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 2}})
+				defer db.Close()
+				for i := 1; i <= 3; i++ {
+					require.Nil(t, db.Set("key", fmt.Sprintf("v%d", i)))
+				}
+				history, err := db.History("key", 0)
+				require.Nil(t, err)
+				require.Equal(t, []interface{}{"v3", "v2", "v1"}, values(history))
+				db.initNewWritableSegment()
+				require.Nil(t, db.Set("key", "v4"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Compaction())
+				require.Nil(t, db.frozenSegments.Merge())
+				history, err = db.History("key", 0)
+				require.Nil(t, err)
+				require.Equal(t, []interface{}{"v4"}, values(history))
+			})
+
+			t.Run("retention keeps versions through merges and reopening", func(t *testing.T) {
+				dir := t.TempDir()
+				opts := Options{Storage: storage, CompactionStrategy: &SizeTieredStrategy{MinThreshold: 2}, Retention: Retention{Versions: 3}}
+				db := openDatabase(t, dir, opts)
+				var seqs []uint64
+				for i := 1; i <= 5; i++ {
+					version, err := db.CompareAndSwap("key", lastOf(seqs), fmt.Sprintf("v%d", i))
+					require.Nil(t, err)
+					seqs = append(seqs, version)
+					db.initNewWritableSegment()
+				}
+				require.Nil(t, db.Delete("key"))
+				require.Nil(t, db.Set("other", "value"))
+				db.initNewWritableSegment()
+				require.Nil(t, db.frozenSegments.Compaction())
+				require.Nil(t, db.frozenSegments.Merge())
+				require.Nil(t, db.Close())
+
+				db = openDatabase(t, dir, opts)
+				defer db.Close()
+				history, err := db.History("key", 0)
+				require.Nil(t, err)
+				require.Equal(t, []interface{}{nil, "v5", "v4"}, values(history))
+				history, err = db.History("key", 2)
+				require.Nil(t, err)
+				require.Len(t, history, 2)
+				require.Equal(t, seqs[4], history[1].Seq)
+
+				value, err := db.GetAt("key", seqs[3])
+				require.Nil(t, err)
+				require.Equal(t, "v4", value)
+				_, err = db.GetAt("key", seqs[1])
+				require.ErrorIs(t, err, index.ErrKeyNotFound, "the version was dropped")
+				_, err = db.Get("key")
+				require.ErrorIs(t, err, index.ErrKeyNotFound)
+			})
+		})
+	}
+
+	t.Run("point in time reads", func(t *testing.T) {
+		db := openDatabase(t, t.TempDir(), Options{})
+		defer db.Close()
+		before := time.Now().Add(-time.Minute)
+		require.Nil(t, db.Set("user/1", "first"))
+		_, err := db.GetAsOf("user/1", before)
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+		value, err := db.GetAsOf("user/1", time.Now())
+		require.Nil(t, err)
+		require.Equal(t, "first", value)
+
+		require.Nil(t, db.DeletePrefix("user/"))
+		_, err = db.GetAsOf("user/1", time.Now())
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+		history, err := db.History("user/1", 0)
+		require.Nil(t, err)
+		require.Equal(t, []interface{}{nil, "first"}, values(history))
+		_, err = db.History("missing", 0)
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+	})
+
+	t.Run("retention by age", func(t *testing.T) {
+		now := time.Now()
+		rows := []DBRow{
+			{Seq: 1, CreationTime: now.Add(-3 * time.Hour).Unix()},
+			{Seq: 2, CreationTime: now.Add(-2 * time.Hour).Unix()},
+			{Seq: 3, CreationTime: now.Add(-30 * time.Minute).Unix()},
+			{Seq: 4, CreationTime: now.Unix()},
+		}
+		require.Equal(t, 1, Retention{Age: time.Hour}.keepFrom(rows, now), "the version that was newest an hour ago is kept")
+		require.Equal(t, 0, Retention{Age: 4 * time.Hour}.keepFrom(rows, now))
+		require.Equal(t, 2, Retention{Age: time.Minute}.keepFrom(rows, now))
+		require.Equal(t, 1, Retention{Versions: 2, Age: time.Hour}.keepFrom(rows, now))
+		require.Equal(t, 4, Retention{}.keepFrom(rows, now))
+	})
+}
+
+func lastOf(seqs []uint64) uint64 {
+	if len(seqs) == 0 {
+		return 0
+	}
+	return seqs[len(seqs)-1]
+}
+
+func TestReadCache(t *testing.T) {
+	db := openDatabase(t, t.TempDir(), Options{CacheSize: 1 << 20})
+	defer db.Close()
+	cached := db.readCache.values.Get
+	requireValue := func(key string, expected interface{}) {
+		t.Helper()
+		value, err := db.Get(key)
+		require.Nil(t, err)
+		require.Equal(t, expected, value)
+	}
+
+	require.Nil(t, db.Set("key", "v1"))
+	_, ok := cached("key")
+	require.False(t, ok, "writes don't fill the cache")
+	requireValue("key", "v1")
+	read, ok := cached("key")
+	require.True(t, ok)
+	require.Equal(t, "v1", read.value)
+	requireValue("key", "v1")
+
+	require.Nil(t, db.Set("key", "v2"))
+	_, ok = cached("key")
+	require.False(t, ok, "a write invalidates the key")
+	requireValue("key", "v2")
+
+	t.Run("negative lookups", func(t *testing.T) {
+		_, err := db.Get("missing")
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+		read, ok := cached("missing")
+		require.True(t, ok)
+		require.False(t, read.found)
+		require.Nil(t, db.Set("missing", "found"))
+		requireValue("missing", "found")
+	})
+
+	t.Run("deletes, batches and transactions invalidate", func(t *testing.T) {
+		for _, key := range []string{"a", "b", "c", "d"} {
+			require.Nil(t, db.Set(key, "old"))
+			requireValue(key, "old")
+		}
+		require.Nil(t, db.Delete("a"))
+		batch := NewWriteBatch()
+		batch.Put("b", "new")
+		require.Nil(t, db.Write(batch))
+		txn := db.Begin()
+		require.Nil(t, txn.Set("c", "new"))
+		require.Nil(t, txn.Commit())
+		_, err := db.CompareAndSwap("d", 0, "new")
+		require.ErrorIs(t, err, ErrVersionMismatch)
+
+		_, err = db.Get("a")
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+		requireValue("b", "new")
+		requireValue("c", "new")
+		requireValue("d", "old")
+		_, version, err := db.GetWithVersion("d")
+		require.Nil(t, err)
+		_, err = db.CompareAndSwap("d", version, "new")
+		require.Nil(t, err)
+		requireValue("d", "new")
+
+		require.Nil(t, db.DeletePrefix(""))
+		for _, key := range []string{"b", "c", "d"} {
+			_, err = db.Get(key)
+			require.ErrorIs(t, err, index.ErrKeyNotFound)
+		}
+	})
+
+	t.Run("expired values aren't served", func(t *testing.T) {
+		require.Nil(t, db.SetWithTTL("ttl", "value", 50*time.Millisecond))
+		requireValue("ttl", "value")
+		time.Sleep(60 * time.Millisecond)
+		_, err := db.Get("ttl")
+		require.ErrorIs(t, err, index.ErrKeyNotFound)
+	})
+}
@@ -10,7 +10,21 @@ var (
 	pmTotalReads      prometheus.Counter
 	pmTotalCompaction prometheus.Counter
 	pmTotalMerge      prometheus.Counter
-	pmSegmentCount    prometheus.Gauge
+	pmTotalConflicts  prometheus.Counter
+	pmTotalMismatches prometheus.Counter
+	pmExpiredReclaims prometheus.Counter
+
+	pmCacheHits   prometheus.Counter
+	pmCacheMisses prometheus.Counter
+
+	pmBloomSkips          prometheus.Counter
+	pmBloomFalsePositives prometheus.Counter
+	pmSegmentCount        prometheus.Gauge
+
+	pmLiveKeys  prometheus.Gauge
+	pmDeadKeys  prometheus.Gauge
+	pmLiveBytes prometheus.Gauge
+	pmDeadBytes prometheus.Gauge
 )
 
 func init() {
@@ -32,15 +46,84 @@ func init() {
 		ConstLabels: prometheus.Labels{"app": "dbexp"},
 	})
 
-	pmTotalCompaction = promauto.NewCounter(prometheus.CounterOpts{
+	pmTotalMerge = promauto.NewCounter(prometheus.CounterOpts{
 		Name:        "expdb_total_merge",
 		Help:        "Total number of Merge operations.",
 		ConstLabels: prometheus.Labels{"app": "dbexp"},
 	})
 
+	pmTotalConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name:        "expdb_total_txn_conflicts",
+		Help:        "Total number of transactions aborted with ErrConflict.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	pmTotalMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name:        "expdb_total_version_mismatches",
+		Help:        "Total number of conditional writes rejected with ErrVersionMismatch.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	pmExpiredReclaims = promauto.NewCounter(prometheus.CounterOpts{
+		Name:        "expdb_expired_keys_reclaimed",
+		Help:        "Total number of expired records dropped by Compaction and Merge.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	// hit ratio: cache_hits / (cache_hits + cache_misses)
+	pmCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name:        "expdb_read_cache_hits",
+		Help:        "Total number of Get operations answered by the read cache.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	pmCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name:        "expdb_read_cache_misses",
+		Help:        "Total number of Get operations the read cache had to look up in the segments.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	pmBloomSkips = promauto.NewCounter(prometheus.CounterOpts{
+		Name:        "expdb_bloom_filter_skips",
+		Help:        "Total number of segment lookups skipped because the segment's Bloom filter ruled the key out.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	// false positive rate: false_positives / (false_positives + skips)
+	pmBloomFalsePositives = promauto.NewCounter(prometheus.CounterOpts{
+		Name:        "expdb_bloom_filter_false_positives",
+		Help:        "Total number of segment lookups the Bloom filter let through for a key the segment doesn't have.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
 	pmSegmentCount = promauto.NewGauge(prometheus.GaugeOpts{
 		Name:        "exdb_segment_count",
 		Help:        "Current number of Immutable segments.",
 		ConstLabels: prometheus.Labels{"app": "dbexp"},
 	})
+
+	pmLiveKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:        "expdb_live_keys",
+		Help:        "Current number of records holding the newest version of a key.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	pmDeadKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:        "expdb_dead_keys",
+		Help:        "Current number of overwritten, deleted or expired records compaction can reclaim.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	pmLiveBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:        "expdb_live_bytes",
+		Help:        "Current size of the live records in bytes.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
+
+	// garbage ratio: dead_bytes / (live_bytes + dead_bytes)
+	pmDeadBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:        "expdb_dead_bytes",
+		Help:        "Current size of the dead records compaction can reclaim in bytes.",
+		ConstLabels: prometheus.Labels{"app": "dbexp"},
+	})
 }
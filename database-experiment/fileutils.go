@@ -1,16 +1,34 @@
 package databaseexperiment
 
 import (
-	"database-experiment/config"
 	"fmt"
 	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
-func getFileAbsolutePath(fileName string) string {
-	return fmt.Sprintf("%s/%s", config.DataFilesFolderPath, fileName)
+func getFileAbsolutePath(dir, fileName string) string {
+	return filepath.Join(dir, fileName)
+}
+
+// isSegmentFile reports whether fileName is a segment, as opposed to one of
+// the files kept next to segments.
+func isSegmentFile(fileName string) bool {
+	return strings.HasSuffix(fileName, ".data") || strings.HasSuffix(fileName, ".data.compact")
 }
 
 func generateDataFileName() string {
 	return fmt.Sprintf("%d-%s.data", time.Now().UnixNano(), uuid.New())
 }
+
+// syncDir flushes the directory entry changes made by renames and removals.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
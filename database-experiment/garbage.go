@@ -0,0 +1,428 @@
+package databaseexperiment
+
+import (
+	"database-experiment/index"
+	"math"
+	"sync"
+	"time"
+)
+
+// SegmentStats reports how much of a segment is garbage that compaction can
+// reclaim. A record is live while it holds the current version of its key,
+// and dead once a newer write supersedes it, a tombstone deletes it or it
+// expires.
+type SegmentStats struct {
+	Id          string
+	Level       int
+	IsCompacted bool
+	// Current is set for the segment writes currently go to.
+	Current   bool
+	LiveKeys  int64
+	DeadKeys  int64
+	LiveBytes int64
+	// DeadBytes also counts the bytes that belong to no key, like the
+	// records that mark batches.
+	DeadBytes int64
+	// ShadowedKeys and ShadowedBytes are the part of the dead records that a
+	// rewrite of the segment on its own keeps: versions only a newer segment
+	// supersedes, tombstones that still hide a key of an older segment and
+	// range tombstones that still delete a version of one.
+	ShadowedKeys  int64
+	ShadowedBytes int64
+}
+
+// GarbageRatio is the share of the segment's bytes that are dead.
+func (s SegmentStats) GarbageRatio() float64 {
+	if s.LiveBytes+s.DeadBytes == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(s.LiveBytes+s.DeadBytes)
+}
+
+// ReclaimableRatio is the share of the segment's bytes that are dead and not
+// shadowed, the ones a rewrite of the segment drops.
+func (s SegmentStats) ReclaimableRatio() float64 {
+	if s.LiveBytes+s.DeadBytes == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes-s.ShadowedBytes) / float64(s.LiveBytes+s.DeadBytes)
+}
+
+// segmentUsage keeps the live and dead counters of a segment. A writable
+// segment shares its usage with the immutable segment it's frozen into.
+type segmentUsage struct {
+	sync.Mutex
+	liveKeys  int64
+	deadKeys  int64
+	liveBytes int64
+	deadBytes int64
+	// shadowedKeys and shadowedBytes count the dead records a rewrite of the
+	// segment keeps, see SegmentStats
+	shadowedKeys  int64
+	shadowedBytes int64
+	// tombstones holds the size of the shadowed tombstones of a writable
+	// segment by their key, a newer write to the key makes them reclaimable
+	tombstones map[string]int64
+	// expiring holds the live records that have a TTL by their key, they're
+	// counted as dead by sweep once they expire.
+	expiring map[string]index.Record
+	// published is set while the counters are part of the Prometheus gauges
+	published bool
+}
+
+func newSegmentUsage() *segmentUsage {
+	return &segmentUsage{expiring: map[string]index.Record{}}
+}
+
+// change adds the deltas to the counters, the caller holds the lock.
+func (u *segmentUsage) change(liveKeys, deadKeys, liveBytes, deadBytes int64) {
+	u.liveKeys += liveKeys
+	u.deadKeys += deadKeys
+	u.liveBytes += liveBytes
+	u.deadBytes += deadBytes
+	if u.published {
+		pmLiveKeys.Add(float64(liveKeys))
+		pmDeadKeys.Add(float64(deadKeys))
+		pmLiveBytes.Add(float64(liveBytes))
+		pmDeadBytes.Add(float64(deadBytes))
+	}
+}
+
+// addLive counts record, the current version of key, as live.
+func (u *segmentUsage) addLive(key string, record index.Record) {
+	u.Lock()
+	defer u.Unlock()
+	u.change(1, 0, record.Size, 0)
+	if record.ExpiresAt != 0 {
+		u.expiring[key] = record
+	}
+}
+
+// addDead counts keys dead records of bytes in total.
+func (u *segmentUsage) addDead(keys, bytes int64) {
+	u.Lock()
+	defer u.Unlock()
+	u.change(0, keys, 0, bytes)
+}
+
+// addShadowed counts keys dead records of bytes in total that a rewrite of
+// the segment keeps.
+func (u *segmentUsage) addShadowed(keys, bytes int64) {
+	u.Lock()
+	defer u.Unlock()
+	u.change(0, keys, 0, bytes)
+	u.shadowedKeys += keys
+	u.shadowedBytes += bytes
+}
+
+// supersede counts record, the live version of key, as dead and as shadowed
+// too when shadowed is set. A record that already expired was counted by
+// sweep, supersede reports whether it counted record.
+func (u *segmentUsage) supersede(key string, record index.Record, shadowed bool) bool {
+	u.Lock()
+	defer u.Unlock()
+	if record.ExpiresAt != 0 {
+		if _, ok := u.expiring[key]; !ok {
+			return false
+		}
+		delete(u.expiring, key)
+	}
+	u.change(-1, 1, -record.Size, record.Size)
+	if shadowed {
+		u.shadowedKeys++
+		u.shadowedBytes += record.Size
+	}
+	return true
+}
+
+// shadow counts keys dead records of bytes in total as shadowed, or as
+// reclaimable again when they're negative.
+func (u *segmentUsage) shadow(keys, bytes int64) {
+	u.Lock()
+	defer u.Unlock()
+	u.shadowedKeys += keys
+	u.shadowedBytes += bytes
+}
+
+// shadowTombstone counts the tombstone of key, the newest version of key in
+// a writable segment, as shadowed while no newer write to key reclaims it.
+func (u *segmentUsage) shadowTombstone(key string, size int64) {
+	u.Lock()
+	defer u.Unlock()
+	if u.tombstones == nil {
+		u.tombstones = map[string]int64{}
+	}
+	u.tombstones[key] = size
+	u.shadowedKeys++
+	u.shadowedBytes += size
+}
+
+// reclaimTombstone counts the tombstone of key shadowTombstone counted as
+// reclaimable, once key is written again.
+func (u *segmentUsage) reclaimTombstone(key string) {
+	u.Lock()
+	defer u.Unlock()
+	if size, ok := u.tombstones[key]; ok {
+		delete(u.tombstones, key)
+		u.shadowedKeys--
+		u.shadowedBytes -= size
+	}
+}
+
+// rangeShadows keeps the versions of the frozen segments that the range
+// tombstones of a writable segment deleted. Rewrites only consult the range
+// tombstones of frozen segments, so the versions are shadowed until the
+// writable segment is frozen too and then they're reclaimable.
+type rangeShadows struct {
+	sync.Mutex
+	frozen bool
+	// counts holds the shadowed keys and bytes by the usage they're in
+	counts map[*segmentUsage][2]int64
+}
+
+// supersede counts record, the live version of key in the segment of usage,
+// as dead.
+func (r *rangeShadows) supersede(usage *segmentUsage, key string, record index.Record) {
+	r.Lock()
+	defer r.Unlock()
+	if !usage.supersede(key, record, !r.frozen) || r.frozen {
+		return
+	}
+	if r.counts == nil {
+		r.counts = map[*segmentUsage][2]int64{}
+	}
+	count := r.counts[usage]
+	r.counts[usage] = [2]int64{count[0] + 1, count[1] + record.Size}
+}
+
+// release makes the versions reclaimable, once the writable segment is
+// frozen.
+func (r *rangeShadows) release() {
+	r.Lock()
+	defer r.Unlock()
+	r.frozen = true
+	for usage, count := range r.counts {
+		usage.shadow(-count[0], -count[1])
+	}
+	r.counts = nil
+}
+
+// sweep counts the live records that expired by now as dead.
+func (u *segmentUsage) sweep(now time.Time) {
+	u.Lock()
+	defer u.Unlock()
+	for key, record := range u.expiring {
+		if record.ExpiresAt <= now.UnixNano() {
+			delete(u.expiring, key)
+			u.change(-1, 1, -record.Size, record.Size)
+		}
+	}
+}
+
+// publish adds the counters to the Prometheus gauges, which follow every
+// change until release.
+func (u *segmentUsage) publish() {
+	u.Lock()
+	defer u.Unlock()
+	if u.published {
+		return
+	}
+	u.published = true
+	pmLiveKeys.Add(float64(u.liveKeys))
+	pmDeadKeys.Add(float64(u.deadKeys))
+	pmLiveBytes.Add(float64(u.liveBytes))
+	pmDeadBytes.Add(float64(u.deadBytes))
+}
+
+// release takes the counters out of the Prometheus gauges again, when the
+// segment is removed or closed.
+func (u *segmentUsage) release() {
+	u.Lock()
+	defer u.Unlock()
+	if !u.published {
+		return
+	}
+	pmLiveKeys.Sub(float64(u.liveKeys))
+	pmDeadKeys.Sub(float64(u.deadKeys))
+	pmLiveBytes.Sub(float64(u.liveBytes))
+	pmDeadBytes.Sub(float64(u.deadBytes))
+	u.published = false
+}
+
+// usageStats returns the stats of the segment as of now.
+func (s *segment) usageStats(now time.Time) SegmentStats {
+	s.usage.sweep(now)
+	s.usage.Lock()
+	defer s.usage.Unlock()
+	return SegmentStats{
+		Id:            s.id,
+		Level:         int(s.header.Level),
+		IsCompacted:   s.header.IsCompacted,
+		LiveKeys:      s.usage.liveKeys,
+		DeadKeys:      s.usage.deadKeys,
+		LiveBytes:     s.usage.liveBytes,
+		DeadBytes:     s.usage.deadBytes,
+		ShadowedKeys:  s.usage.shadowedKeys,
+		ShadowedBytes: s.usage.shadowedBytes,
+	}
+}
+
+// newestRecord returns the newest version of key in the segment, consulting
+// the Bloom filter first without counting it in the filter's metrics.
+func (r *immutableSegment) newestRecord(key string) (index.Record, error) {
+	if filter, ok := r.filter.Load().(*bloomFilter); ok && !filter.MayContain(key) {
+		return index.Record{}, index.ErrKeyNotFound
+	}
+	return r.indexStrategy.GetRecord(key)
+}
+
+// dataSize is the size of the records of the segment, without the header
+// and the key blocks of an SSTable.
+func (r *immutableSegment) dataSize() int64 {
+	if table, ok := r.indexStrategy.(*sstableIndex); ok {
+		return table.dataEnd - headerLength
+	}
+	return r.size() - headerLength
+}
+
+// forEachKey calls fn with the versions of every key of seg, oldest first.
+func forEachKey(seg *immutableSegment, fn func(key string, versions []index.Record)) error {
+	if table, ok := seg.indexStrategy.(*sstableIndex); ok {
+		return table.forEachKey(fn)
+	}
+	for _, key := range seg.GetUniqueKeys() {
+		versions, err := seg.indexStrategy.GetVersions(key)
+		if err == index.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fn(key, versions)
+	}
+	return nil
+}
+
+// supersede counts the version of key in the newest frozen segment that has
+// it as dead and shadowed, it's called when key is first written to the
+// current segment. A write racing with the rewrite of that segment isn't
+// counted, the output of the rewrite only sees the writes made before it
+// finished. A version a range tombstone already deleted isn't counted again.
+// supersede reports whether a frozen segment has a version of key.
+func (s *Segments) supersede(key string) bool {
+	segments := s.snapshot()
+	defer releaseSegments(segments, s.logger)
+	seg, record, ok := s.newestLive(segments, key)
+	if ok {
+		seg.usage.supersede(key, record, true)
+	}
+	return seg != nil
+}
+
+// newestLive returns the version of key in the newest of segments that has
+// it, and the segment, and reports whether it's live: not a tombstone and
+// not deleted by a range tombstone. The segment is nil when none of them has
+// key.
+func (s *Segments) newestLive(segments []Segment, key string) (*immutableSegment, index.Record, bool) {
+	var deletedAt uint64
+	for i := len(segments) - 1; i > -1; i-- {
+		seg, ok := segments[i].(*immutableSegment)
+		if !ok {
+			continue
+		}
+		if segDeletedAt := seg.rangeDeletedAt(key, math.MaxUint64); segDeletedAt > deletedAt {
+			deletedAt = segDeletedAt
+		}
+		record, err := seg.newestRecord(key)
+		if err == index.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			s.logger.Printf("couldn't update the garbage of segment %s: %v\n", seg.GetId(), err)
+			return nil, index.Record{}, false
+		}
+		return seg, record, !record.Tombstone && record.Seq > deletedAt
+	}
+	return nil, index.Record{}, false
+}
+
+// anyHasKey reports whether one of segments may have a version of key, a
+// segment that fails to look it up is assumed to have it.
+func anyHasKey(segments []Segment, key string) bool {
+	for _, seg := range segments {
+		if immutable, ok := seg.(*immutableSegment); ok {
+			if _, err := immutable.newestRecord(key); err != index.ErrKeyNotFound {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isShadowed reports whether a segment in newer or the current segment has
+// a version of key or the current segment a range tombstone that covers it.
+// The range tombstones of newer are left to the caller, a rewrite drops the
+// versions they delete.
+func (s *Segments) isShadowed(key string, newer []Segment) bool {
+	return anyHasKey(newer, key) || s.inCurrentSegment != nil && s.inCurrentSegment(key)
+}
+
+// initUsage counts the live and dead records of seg, which is newer than the
+// segments in older and older than the ones in newer, and publishes them.
+func (s *Segments) initUsage(seg *immutableSegment, older, newer []Segment) error {
+	usage := newSegmentUsage()
+	now := time.Now()
+	var accounted int64
+	err := forEachKey(seg, func(key string, versions []index.Record) {
+		for _, version := range versions[:len(versions)-1] {
+			usage.addDead(1, version.Size)
+			accounted += version.Size
+		}
+		newest := versions[len(versions)-1]
+		accounted += newest.Size
+		switch {
+		case seg.rangeDeletedAt(key, math.MaxUint64) > newest.Seq || rangeDeletedAt(newer, key, math.MaxUint64) > newest.Seq:
+			usage.addDead(1, newest.Size)
+		case newest.Tombstone || newest.ExpiresAt != 0 && newest.ExpiresAt <= now.UnixNano():
+			if anyHasKey(older, key) {
+				usage.addShadowed(1, newest.Size)
+			} else {
+				usage.addDead(1, newest.Size)
+			}
+		case s.isShadowed(key, newer):
+			usage.addShadowed(1, newest.Size)
+		default:
+			usage.addLive(key, newest)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, tombstone := range seg.rangeTombstones() {
+		accounted += tombstone.record.Size
+		deletes := false
+		for _, other := range older {
+			if deletes, err = hasVersionBefore(other, tombstone.start, tombstone.end, tombstone.record.Seq); err != nil || deletes {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if deletes {
+			usage.addShadowed(0, tombstone.record.Size)
+		} else {
+			usage.addDead(0, tombstone.record.Size)
+		}
+	}
+	// versions the index doesn't know about, like the older versions of a
+	// segment recovered from a hint file listing only the newest ones, and
+	// batch records
+	if unaccounted := seg.dataSize() - accounted; unaccounted > 0 {
+		usage.addDead(0, unaccounted)
+	}
+	seg.usage.release()
+	seg.usage = usage
+	usage.publish()
+	return nil
+}
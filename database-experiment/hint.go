@@ -0,0 +1,203 @@
+package databaseexperiment
+
+import (
+	"bufio"
+	"bytes"
+	"database-experiment/index"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// A hint file sits next to an immutable segment and lists the entries of its
+// index, every version of every key, so the index can be rebuilt without
+// decoding every record:
+//
+//	| magic (4) | version (1) | segment size (8) | max seq (8) | entries... | crc32 of everything before (4) |
+//
+// where every entry is
+//
+//	| key length (uvarint) | key | offset (uvarint) | size (uvarint) | creation time (varint) | seq (uvarint) | flags (uvarint) | expires at (varint) |
+//
+// where the low bit of flags marks tombstones and the next one range
+// tombstones, listed under their start key.
+//
+// The segment size ties the hint to the exact segment contents it was built
+// from, a hint for a different size is ignored. Hints of an older version are
+// ignored as well and the segment is scanned instead.
+const (
+	hintFileSuffix = ".hint"
+	hintMagic      = "HINT"
+	hintVersion    = 3
+)
+
+var (
+	errInvalidHintFile = errors.New("invalid hint file")
+)
+
+const (
+	recordFlagTombstone      = 1 << 0
+	recordFlagRangeTombstone = 1 << 1
+)
+
+// recordFlags packs the flags of an index record for hint files and
+// sstable key blocks.
+func recordFlags(record index.Record) uint64 {
+	if record.Tombstone {
+		return recordFlagTombstone
+	}
+	return 0
+}
+
+func hintFilePath(segmentPath string) string {
+	return segmentPath + hintFileSuffix
+}
+
+type hintEntry struct {
+	key            string
+	record         index.Record
+	rangeTombstone bool
+}
+
+// writeHintFile writes the hint file of the segment at segmentPath from idx
+// and the range tombstones of the segment. It's written to a temporary file
+// first and renamed, so a reader never sees a partial hint.
+func writeHintFile(segmentPath string, segmentSize int64, maxSeq uint64, idx index.Index, ranges []rangeTombstone) error {
+	tmpPath := hintFilePath(segmentPath) + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fs.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	checksum := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(file, checksum))
+	w.WriteString(hintMagic)
+	w.WriteByte(hintVersion)
+	binary.Write(w, binary.LittleEndian, segmentSize)
+	binary.Write(w, binary.LittleEndian, maxSeq)
+
+	varint := make([]byte, binary.MaxVarintLen64)
+	writeEntry := func(key string, record index.Record, flags uint64) error {
+		offset, err := strconv.ParseInt(record.Offset, 16, 64)
+		if err != nil {
+			return err
+		}
+		w.Write(varint[:binary.PutUvarint(varint, uint64(len(key)))])
+		w.WriteString(key)
+		w.Write(varint[:binary.PutUvarint(varint, uint64(offset))])
+		w.Write(varint[:binary.PutUvarint(varint, uint64(record.Size))])
+		w.Write(varint[:binary.PutVarint(varint, record.CreationTime)])
+		w.Write(varint[:binary.PutUvarint(varint, record.Seq)])
+		w.Write(varint[:binary.PutUvarint(varint, flags)])
+		w.Write(varint[:binary.PutVarint(varint, record.ExpiresAt)])
+		return nil
+	}
+	for _, key := range idx.AllKeys() {
+		versions, err := idx.GetVersions(key)
+		if err != nil {
+			continue // deleted while the hint was being written
+		}
+		for _, record := range versions {
+			if err = writeEntry(key, record, recordFlags(record)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, tombstone := range ranges {
+		if err = writeEntry(tombstone.start, tombstone.record, recordFlagRangeTombstone); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = binary.Write(file, binary.LittleEndian, checksum.Sum32()); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, hintFilePath(segmentPath)); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(segmentPath))
+}
+
+// readHintFile returns the entries of the hint file of the segment at
+// segmentPath and the highest sequence number of the segment. The whole file
+// is verified before anything is returned.
+func readHintFile(segmentPath string, segmentSize int64) ([]hintEntry, uint64, error) {
+	data, err := os.ReadFile(hintFilePath(segmentPath))
+	if err != nil {
+		return nil, 0, err
+	}
+	prefixLength := len(hintMagic) + 1 + 8 + 8
+	if len(data) < prefixLength+4 {
+		return nil, 0, errInvalidHintFile
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(sum) ||
+		string(body[:len(hintMagic)]) != hintMagic ||
+		body[len(hintMagic)] != hintVersion {
+		return nil, 0, errInvalidHintFile
+	}
+	if int64(binary.LittleEndian.Uint64(body[len(hintMagic)+1:])) != segmentSize {
+		return nil, 0, errInvalidHintFile
+	}
+	maxSeq := binary.LittleEndian.Uint64(body[len(hintMagic)+1+8:])
+
+	r := bytes.NewReader(body[prefixLength:])
+	var entries []hintEntry
+	for r.Len() > 0 {
+		keyLen, err := binary.ReadUvarint(r)
+		if err != nil || keyLen > uint64(r.Len()) {
+			return nil, 0, errInvalidHintFile
+		}
+		key := make([]byte, keyLen)
+		r.Read(key)
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, errInvalidHintFile
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, errInvalidHintFile
+		}
+		creationTime, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, 0, errInvalidHintFile
+		}
+		seq, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, errInvalidHintFile
+		}
+		flags, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, errInvalidHintFile
+		}
+		expiresAt, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, 0, errInvalidHintFile
+		}
+		entries = append(entries, hintEntry{
+			key: string(key),
+			record: index.Record{
+				Offset:       formatOffset(int64(offset)),
+				Size:         int64(size),
+				CreationTime: creationTime,
+				Seq:          seq,
+				Tombstone:    flags&recordFlagTombstone != 0,
+				ExpiresAt:    expiresAt,
+			},
+			rangeTombstone: flags&recordFlagRangeTombstone != 0,
+		})
+	}
+	return entries, maxSeq, nil
+}
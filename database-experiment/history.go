@@ -0,0 +1,176 @@
+package databaseexperiment
+
+import (
+	"database-experiment/index"
+	"sort"
+	"time"
+)
+
+// Retention keeps older versions of keys through Compaction and Merge, so
+// History and the point-in-time reads can still find them. A version is kept
+// when either rule keeps it, the zero value keeps only the newest version.
+// Versions a range tombstone deleted are kept for Age but don't count towards
+// Versions.
+type Retention struct {
+	// Versions is how many of the newest versions of every key are kept.
+	Versions int
+	// Age keeps the versions needed to read any point in time within it:
+	// the ones written since and the one that was newest Age ago.
+	Age time.Duration
+}
+
+// keepFrom returns the index of the oldest of rows, ordered by sequence
+// number, that r keeps.
+func (r Retention) keepFrom(rows []DBRow, now time.Time) int {
+	keep := len(rows)
+	if r.Versions > 0 {
+		keep = len(rows) - r.Versions
+		if keep < 0 {
+			keep = 0
+		}
+	}
+	if r.Age > 0 {
+		i := len(rows) - 1
+		for i > 0 && r.keepsSince(rows[i].CreationTime, now) {
+			i--
+		}
+		if i < keep {
+			keep = i
+		}
+	}
+	return keep
+}
+
+// keepsSince reports whether a write at creationTime is within Age of now.
+func (r Retention) keepsSince(creationTime int64, now time.Time) bool {
+	return r.Age > 0 && creationTime > now.Add(-r.Age).Unix()
+}
+
+// Version is a version of a key as History returns it.
+type Version struct {
+	// Seq is the sequence number of the write, see GetWithVersion.
+	Seq uint64
+	// CreatedAt is when the version was written, to the second.
+	CreatedAt time.Time
+	// ExpiresAt is when the version expires, zero when it never does.
+	ExpiresAt time.Time
+	Value     interface{}
+	// Deleted marks the versions that deleted the key, they have no value.
+	Deleted bool
+}
+
+// GetAt returns the value key had right after the write with sequence number
+// seq. Versions compaction already dropped, see Options.Retention, read as
+// not found.
+func (db *Database) GetAt(key string, seq uint64) (interface{}, error) {
+	pmTotalReads.Inc()
+	return db.getAt(key, seq)
+}
+
+// GetAsOf returns the value key had at t, to the second. Versions compaction
+// already dropped, see Options.Retention, read as not found.
+func (db *Database) GetAsOf(key string, t time.Time) (interface{}, error) {
+	pmTotalReads.Inc()
+	versions, err := db.history(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.CreatedAt.After(t) {
+			continue
+		}
+		if version.Deleted || !version.ExpiresAt.IsZero() && !version.ExpiresAt.After(t) {
+			break
+		}
+		return version.Value, nil
+	}
+	return nil, index.ErrKeyNotFound
+}
+
+// History returns the versions of key that are still stored, the newest
+// first and at most limit of them when limit is positive. It returns
+// index.ErrKeyNotFound when there is none.
+func (db *Database) History(key string, limit int) ([]Version, error) {
+	pmTotalReads.Inc()
+	versions, err := db.history(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, index.ErrKeyNotFound
+	}
+	if limit > 0 && len(versions) > limit {
+		versions = versions[:limit]
+	}
+	return versions, nil
+}
+
+// history returns every stored version of key, the newest first, including
+// the range tombstones that deleted it.
+func (db *Database) history(key string) ([]Version, error) {
+	segments := db.readSegments()
+	defer releaseSegments(segments, db.opts.Logger)
+	rows, err := versionRows(segments, key)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[uint64]bool{}
+	for _, row := range rows {
+		seen[row.Seq] = true
+	}
+	for _, seg := range segments {
+		for _, tombstone := range seg.rangeTombstones() {
+			if tombstone.covers(key) && !seen[tombstone.record.Seq] {
+				seen[tombstone.record.Seq] = true
+				rows = append(rows, DBRow{Key: key, Type: RecordTypeTombstone, Seq: tombstone.record.Seq, CreationTime: tombstone.record.CreationTime})
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Seq > rows[j].Seq
+	})
+	versions := make([]Version, len(rows))
+	for i, row := range rows {
+		versions[i] = Version{Seq: row.Seq, CreatedAt: time.Unix(row.CreationTime, 0), Deleted: row.isTombstone()}
+		if !versions[i].Deleted {
+			versions[i].Value = row.Value
+		}
+		if row.ExpiresAt != 0 {
+			versions[i].ExpiresAt = time.Unix(0, row.ExpiresAt)
+		}
+	}
+	return versions, nil
+}
+
+// versionRows returns every version of key stored in segments ordered by
+// sequence number. A version found in more than one segment, like one being
+// rewritten, is returned once.
+func versionRows(segments []Segment, key string) ([]DBRow, error) {
+	var rows []DBRow
+	seen := map[uint64]bool{}
+	for _, seg := range segments {
+		versions, err := seg.GetIndexStrategy().GetVersions(key)
+		if err == index.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			// versions written before sequence numbers existed are all zero
+			if seen[version.Seq] && version.Seq != 0 {
+				continue
+			}
+			seen[version.Seq] = true
+			row, err := seg.ReadRowAt(key, version.Seq)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Seq < rows[j].Seq
+	})
+	return rows, nil
+}
@@ -8,15 +8,25 @@ import (
 
 type Record struct {
 	Offset       string
+	Size         int64
 	CreationTime int64
+	Seq          uint64
+	// Tombstone marks a deletion of the key.
+	Tombstone bool
+	// ExpiresAt is the unix time in nanoseconds the record expires at, zero
+	// means it never does.
+	ExpiresAt int64
 }
 
+// HashMapIndex keeps the versions of every key, oldest first.
 type HashMapIndex struct {
 	sync.RWMutex
-	hm map[string]Record
+	hm map[string][]Record
 }
 
 func (m *HashMapIndex) AllKeys() []string {
+	m.RLock()
+	defer m.RUnlock()
 	var keys []string
 	for key := range m.hm {
 		keys = append(keys, key)
@@ -36,43 +46,71 @@ func (m *HashMapIndex) CollectPromMetrics() {
 }
 
 func (m *HashMapIndex) Get(key string) (string, error) {
+	record, err := m.GetRecord(key)
+	if err != nil {
+		return "", err
+	}
+	return record.Offset, nil
+}
+
+func (m *HashMapIndex) GetRecord(key string) (Record, error) {
 	m.RLock()
 	defer m.RUnlock()
-	data, exists := m.hm[key]
+	versions, exists := m.hm[key]
 	if !exists {
-		return "", ErrKeyNotFound
+		return Record{}, ErrKeyNotFound
 	}
-	return data.Offset, nil
+	return versions[len(versions)-1], nil
 }
 
-func (m *HashMapIndex) GetCreationTime(key string) (int64, error) {
+func (m *HashMapIndex) GetRecordAt(key string, seq uint64) (Record, error) {
+	m.RLock()
+	defer m.RUnlock()
+	versions := m.hm[key]
+	for i := len(versions) - 1; i > -1; i-- {
+		if versions[i].Seq <= seq {
+			return versions[i], nil
+		}
+	}
+	return Record{}, ErrKeyNotFound
+}
+
+func (m *HashMapIndex) GetVersions(key string) ([]Record, error) {
 	m.RLock()
 	defer m.RUnlock()
-	data, exists := m.hm[key]
+	versions, exists := m.hm[key]
 	if !exists {
-		return 0, ErrKeyNotFound
+		return nil, ErrKeyNotFound
 	}
-	return data.CreationTime, nil
+	return append([]Record(nil), versions...), nil
+}
+
+func (m *HashMapIndex) GetCreationTime(key string) (int64, error) {
+	record, err := m.GetRecord(key)
+	if err != nil {
+		return 0, err
+	}
+	return record.CreationTime, nil
 }
 
 func (m *HashMapIndex) Delete(key string) {
+	m.Lock()
+	defer m.Unlock()
 	delete(m.hm, key)
 }
 
-func (m *HashMapIndex) Set(key, offset string, creationTime int64) {
+func (m *HashMapIndex) Set(key string, record Record) {
 	m.Lock()
 	defer m.Unlock()
-	if _, exists := m.hm[key]; !exists && entryCount != nil {
+	versions, exists := m.hm[key]
+	if !exists && entryCount != nil {
 		entryCount.Inc()
 	}
-	m.hm[key] = Record{
-		Offset:       offset,
-		CreationTime: creationTime,
-	}
+	m.hm[key] = insertVersion(versions, record)
 }
 
 func NewHashMapIndex() Index {
 	return &HashMapIndex{
-		hm: map[string]Record{},
+		hm: map[string][]Record{},
 	}
 }
@@ -6,11 +6,43 @@ var (
 	ErrKeyNotFound = errors.New("key not found")
 )
 
+// Index maps every key of a segment to the records holding its versions.
 type Index interface {
+	// Get returns the offset of the newest version of key.
 	Get(key string) (string, error)
+	// GetRecord returns the newest version of key.
+	GetRecord(key string) (Record, error)
+	// GetRecordAt returns the newest version of key whose Seq is at most seq.
+	GetRecordAt(key string, seq uint64) (Record, error)
+	// GetVersions returns every version of key, oldest first.
+	GetVersions(key string) ([]Record, error)
 	GetCreationTime(key string) (int64, error)
-	Set(key, offset string, creationTime int64)
+	// Set adds record as a version of key, the versions are kept ordered by
+	// Seq and a record is newer than the ones with the same Seq.
+	Set(key string, record Record)
+	// Delete removes every version of key.
 	Delete(key string)
 	AllKeys() []string
 	CollectPromMetrics()
 }
+
+// insertVersion adds record to versions, which are ordered by Seq.
+func insertVersion(versions []Record, record Record) []Record {
+	i := len(versions)
+	for i > 0 && versions[i-1].Seq > record.Seq {
+		i--
+	}
+	versions = append(versions, Record{})
+	copy(versions[i+1:], versions[i:])
+	versions[i] = record
+	return versions
+}
+
+// OrderedIndex is an Index that keeps its keys sorted and can list a range of
+// them without visiting the rest.
+type OrderedIndex interface {
+	Index
+	// KeysInRange returns the keys in [start, end) in ascending order, an
+	// empty end means there is no upper bound.
+	KeysInRange(start, end string) []string
+}
@@ -0,0 +1,200 @@
+package index
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"math/rand"
+	"sync"
+)
+
+const (
+	skipListMaxLevel = 24
+	// every level holds about a quarter of the nodes of the level below
+	skipListBranching = 4
+)
+
+type skipListNode struct {
+	key      string
+	versions []Record
+	next     []*skipListNode
+}
+
+// SkipListIndex keeps the keys sorted, so it can answer range queries, and
+// the versions of every key oldest first.
+type SkipListIndex struct {
+	sync.RWMutex
+	head   *skipListNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+var (
+	skipListEntryCount prometheus.Counter
+)
+
+func (m *SkipListIndex) CollectPromMetrics() {
+	skipListEntryCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "index_sl_entry_count",
+		Help: "The total number of entries in skiplist.",
+	})
+}
+
+// findGreaterOrEqual returns the first node whose key is at least key. When
+// prev isn't nil it's filled with the last node before it on every level.
+func (m *SkipListIndex) findGreaterOrEqual(key string, prev []*skipListNode) *skipListNode {
+	node := m.head
+	for level := m.level - 1; level > -1; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (m *SkipListIndex) find(key string) *skipListNode {
+	node := m.findGreaterOrEqual(key, nil)
+	if node == nil || node.key != key {
+		return nil
+	}
+	return node
+}
+
+func (m *SkipListIndex) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && m.rnd.Intn(skipListBranching) == 0 {
+		level++
+	}
+	return level
+}
+
+func (m *SkipListIndex) AllKeys() []string {
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]string, 0, m.length)
+	for node := m.head.next[0]; node != nil; node = node.next[0] {
+		keys = append(keys, node.key)
+	}
+	return keys
+}
+
+func (m *SkipListIndex) KeysInRange(start, end string) []string {
+	m.RLock()
+	defer m.RUnlock()
+	var keys []string
+	for node := m.findGreaterOrEqual(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		keys = append(keys, node.key)
+	}
+	return keys
+}
+
+func (m *SkipListIndex) Get(key string) (string, error) {
+	record, err := m.GetRecord(key)
+	if err != nil {
+		return "", err
+	}
+	return record.Offset, nil
+}
+
+func (m *SkipListIndex) GetRecord(key string) (Record, error) {
+	m.RLock()
+	defer m.RUnlock()
+	node := m.find(key)
+	if node == nil {
+		return Record{}, ErrKeyNotFound
+	}
+	return node.versions[len(node.versions)-1], nil
+}
+
+func (m *SkipListIndex) GetRecordAt(key string, seq uint64) (Record, error) {
+	m.RLock()
+	defer m.RUnlock()
+	node := m.find(key)
+	if node == nil {
+		return Record{}, ErrKeyNotFound
+	}
+	for i := len(node.versions) - 1; i > -1; i-- {
+		if node.versions[i].Seq <= seq {
+			return node.versions[i], nil
+		}
+	}
+	return Record{}, ErrKeyNotFound
+}
+
+func (m *SkipListIndex) GetVersions(key string) ([]Record, error) {
+	m.RLock()
+	defer m.RUnlock()
+	node := m.find(key)
+	if node == nil {
+		return nil, ErrKeyNotFound
+	}
+	return append([]Record(nil), node.versions...), nil
+}
+
+func (m *SkipListIndex) GetCreationTime(key string) (int64, error) {
+	record, err := m.GetRecord(key)
+	if err != nil {
+		return 0, err
+	}
+	return record.CreationTime, nil
+}
+
+func (m *SkipListIndex) Delete(key string) {
+	m.Lock()
+	defer m.Unlock()
+	prev := make([]*skipListNode, skipListMaxLevel)
+	node := m.findGreaterOrEqual(key, prev)
+	if node == nil || node.key != key {
+		return
+	}
+	for level := range node.next {
+		prev[level].next[level] = node.next[level]
+	}
+	for m.level > 1 && m.head.next[m.level-1] == nil {
+		m.level--
+	}
+	m.length--
+}
+
+func (m *SkipListIndex) Set(key string, record Record) {
+	m.Lock()
+	defer m.Unlock()
+	prev := make([]*skipListNode, skipListMaxLevel)
+	node := m.findGreaterOrEqual(key, prev)
+	if node != nil && node.key == key {
+		node.versions = insertVersion(node.versions, record)
+		return
+	}
+
+	level := m.randomLevel()
+	for ; m.level < level; m.level++ {
+		prev[m.level] = m.head
+	}
+	node = &skipListNode{
+		key:      key,
+		versions: []Record{record},
+		next:     make([]*skipListNode, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	m.length++
+	if skipListEntryCount != nil {
+		skipListEntryCount.Inc()
+	}
+}
+
+func NewSkipListIndex() Index {
+	return &SkipListIndex{
+		head:  &skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
@@ -0,0 +1,339 @@
+package databaseexperiment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The MANIFEST lists the live segments of a database as an append-only log
+// of edits, every edit adding and removing segments at once:
+//
+//	| magic (4) | version (1) | edit... |
+//
+// where an edit is framed like a record:
+//
+//	| length (4) | crc32 of payload (4) | payload |
+//
+// and its payload lists the changed segments:
+//
+//	| count (uvarint) | op (1) | id length (uvarint) | id | ...
+//
+// An edit of a rewrite that drops versions also raises the last sequence
+// number, with an op holding it instead of an id:
+//
+//	| op (1) | last seq (uvarint) |
+//
+// so sequence numbers stay monotonic when the newest writes are dropped.
+//
+// Recovery replays the edits and trusts the result instead of the directory
+// listing. An edit torn by a crash is dropped, so a compaction either
+// replaced its inputs entirely or not at all.
+const (
+	manifestFileName = "MANIFEST"
+	manifestMagic    = "MNFS"
+	manifestVersion  = 1
+
+	manifestOpAdd     = 1
+	manifestOpRemove  = 2
+	manifestOpLastSeq = 3
+
+	// the manifest is rewritten as a single edit once it has this many
+	manifestMaxEdits = 1000
+)
+
+var (
+	errInvalidManifest = errors.New("invalid manifest")
+)
+
+type manifestEdit struct {
+	added   []string
+	removed []string
+	// lastSeq is kept when it's higher than the manifest's, zero is none
+	lastSeq uint64
+}
+
+func (e manifestEdit) encode() []byte {
+	varint := make([]byte, binary.MaxVarintLen64)
+	count := len(e.added) + len(e.removed)
+	if e.lastSeq != 0 {
+		count++
+	}
+	payload := append([]byte(nil), varint[:binary.PutUvarint(varint, uint64(count))]...)
+	appendOp := func(op byte, id string) {
+		payload = append(payload, op)
+		payload = append(payload, varint[:binary.PutUvarint(varint, uint64(len(id)))]...)
+		payload = append(payload, id...)
+	}
+	for _, id := range e.added {
+		appendOp(manifestOpAdd, id)
+	}
+	for _, id := range e.removed {
+		appendOp(manifestOpRemove, id)
+	}
+	if e.lastSeq != 0 {
+		payload = append(payload, manifestOpLastSeq)
+		payload = append(payload, varint[:binary.PutUvarint(varint, e.lastSeq)]...)
+	}
+	frame := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+	return append(frame, payload...)
+}
+
+func decodeManifestEdit(payload []byte) (manifestEdit, error) {
+	var edit manifestEdit
+	r := bytes.NewReader(payload)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return edit, errInvalidManifest
+	}
+	for i := uint64(0); i < count; i++ {
+		op, err := r.ReadByte()
+		if err != nil {
+			return edit, errInvalidManifest
+		}
+		if op == manifestOpLastSeq {
+			if edit.lastSeq, err = binary.ReadUvarint(r); err != nil {
+				return edit, errInvalidManifest
+			}
+			continue
+		}
+		idLen, err := binary.ReadUvarint(r)
+		if err != nil || idLen > uint64(r.Len()) {
+			return edit, errInvalidManifest
+		}
+		id := make([]byte, idLen)
+		r.Read(id)
+		switch op {
+		case manifestOpAdd:
+			edit.added = append(edit.added, string(id))
+		case manifestOpRemove:
+			edit.removed = append(edit.removed, string(id))
+		default:
+			return edit, errInvalidManifest
+		}
+	}
+	return edit, nil
+}
+
+// manifest keeps the MANIFEST of a database open for appending edits.
+type manifest struct {
+	sync.Mutex
+	dir    string
+	file   *os.File
+	live   map[string]struct{}
+	edits  int
+	logger *log.Logger
+	// lastSeq is a floor for the sequence numbers of the database
+	lastSeq uint64
+}
+
+func manifestPath(dir string) string {
+	return getFileAbsolutePath(dir, manifestFileName)
+}
+
+// openManifest replays the MANIFEST in dir, it returns fs.ErrNotExist when
+// there is none.
+func openManifest(dir string, logger *log.Logger) (*manifest, error) {
+	path := manifestPath(dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(manifestMagic)+1 || string(data[:len(manifestMagic)]) != manifestMagic {
+		return nil, fmt.Errorf("couldn't open manifest: %w", errInvalidManifest)
+	}
+	if data[len(manifestMagic)] != manifestVersion {
+		return nil, fmt.Errorf("couldn't open manifest: unsupported version %d", data[len(manifestMagic)])
+	}
+	m := &manifest{dir: dir, live: map[string]struct{}{}, logger: logger}
+	offset := len(manifestMagic) + 1
+	for offset < len(data) {
+		if len(data)-offset < 8 {
+			break
+		}
+		length := int(binary.LittleEndian.Uint32(data[offset:]))
+		if length > len(data)-offset-8 {
+			break
+		}
+		payload := data[offset+8 : offset+8+length]
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[offset+4:]) {
+			break
+		}
+		edit, err := decodeManifestEdit(payload)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't replay manifest edit at offset %d: %w", offset, err)
+		}
+		m.replay(edit)
+		offset += 8 + length
+	}
+
+	if m.file, err = os.OpenFile(path, os.O_WRONLY, fs.ModePerm); err != nil {
+		return nil, err
+	}
+	if offset < len(data) {
+		// the edit a crash interrupted never happened
+		logger.Printf("Dropped torn manifest edit at offset %d\n", offset)
+		if err = m.file.Truncate(int64(offset)); err == nil {
+			err = m.file.Sync()
+		}
+		if err != nil {
+			m.file.Close()
+			return nil, err
+		}
+	}
+	if _, err = m.file.Seek(int64(offset), io.SeekStart); err != nil {
+		m.file.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// createManifest writes a MANIFEST listing ids as live, replacing the file
+// atomically, and opens it.
+func createManifest(dir string, ids []string, logger *log.Logger) (*manifest, error) {
+	m := &manifest{dir: dir, live: map[string]struct{}{}, logger: logger}
+	for _, id := range ids {
+		m.live[id] = struct{}{}
+	}
+	if err := m.rewrite(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *manifest) replay(edit manifestEdit) {
+	for _, id := range edit.added {
+		m.live[id] = struct{}{}
+	}
+	for _, id := range edit.removed {
+		delete(m.live, id)
+	}
+	if edit.lastSeq > m.lastSeq {
+		m.lastSeq = edit.lastSeq
+	}
+	m.edits++
+}
+
+// apply appends edit and syncs it, the edit is durable once apply returns.
+func (m *manifest) apply(edit manifestEdit) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, err := m.file.Write(edit.encode()); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.replay(edit)
+	if m.edits < manifestMaxEdits {
+		return nil
+	}
+	if err := m.rewrite(); err != nil {
+		// the edit is already durable, the long manifest is still valid
+		m.logger.Printf("couldn't rewrite manifest: %v\n", err)
+	}
+	return nil
+}
+
+// rewrite replaces the manifest with a single edit adding the live segments.
+// The caller holds the lock.
+func (m *manifest) rewrite() error {
+	edit := manifestEdit{added: m.liveIds(), lastSeq: m.lastSeq}
+	data := append([]byte(manifestMagic), manifestVersion)
+	data = append(data, edit.encode()...)
+
+	path := manifestPath(m.dir)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fs.ModePerm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err == nil {
+		err = syncDir(m.dir)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if m.file != nil {
+		m.file.Close()
+	}
+	m.file = file
+	m.edits = 1
+	return nil
+}
+
+// liveIds returns the live segments sorted by id.
+func (m *manifest) liveIds() []string {
+	ids := make([]string, 0, len(m.live))
+	for id := range m.live {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (m *manifest) isLive(id string) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.live[id]
+	return ok
+}
+
+func (m *manifest) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	return m.file.Close()
+}
+
+// removeOrphanedFiles removes the files in dir that belong to no live
+// segment: outputs of a compaction or merge that crashed before its
+// manifest edit, inputs it didn't get to remove after it, their hint and
+// bloom files and the temporary files of interrupted writes.
+func (m *manifest) removeOrphanedFiles() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		var orphaned bool
+		switch {
+		case entry.IsDir():
+		case strings.HasSuffix(name, ".tmp"):
+			orphaned = true
+		case isSegmentFile(name):
+			orphaned = !m.isLive(name)
+		case strings.HasSuffix(name, hintFileSuffix) || strings.HasSuffix(name, bloomFileSuffix):
+			id := strings.TrimSuffix(strings.TrimSuffix(name, hintFileSuffix), bloomFileSuffix)
+			orphaned = isSegmentFile(id) && !m.isLive(id)
+		}
+		if !orphaned {
+			continue
+		}
+		if err = os.Remove(filepath.Join(m.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		m.logger.Printf("Removed orphaned file %s\n", name)
+	}
+	return syncDir(m.dir)
+}
@@ -0,0 +1,89 @@
+package databaseexperiment
+
+import (
+	"database-experiment/config"
+	"database-experiment/index"
+	"log"
+	"time"
+)
+
+// StorageMode selects how a Database lays out its segments.
+type StorageMode int
+
+const (
+	// LogStorage keeps every segment as an append-only log with an in-memory
+	// index of all its keys.
+	LogStorage StorageMode = iota
+	// LSMStorage writes to a sorted memtable, the current segment indexed by
+	// a skiplist, and flushes it to an SSTable when it's frozen. Compaction
+	// and merge write SSTables too, so only their block indexes are kept in
+	// memory.
+	LSMStorage
+)
+
+// Options configures a Database opened with Open. Zero values are replaced
+// with the defaults from the config package.
+type Options struct {
+	// SegmentSize is the size in bytes after which the current segment is
+	// frozen and a new writable segment is created.
+	SegmentSize int64
+	// CompactionInterval is how often the background compaction and merge run.
+	CompactionInterval time.Duration
+	// IndexFactory creates the index used by every segment. Scans of an index
+	// that implements index.OrderedIndex, like index.NewSkipListIndex, don't
+	// have to sort all of its keys.
+	IndexFactory func() index.Index
+	// Logger receives the database's progress and error messages.
+	Logger *log.Logger
+	// Storage is the storage mode, LogStorage by default.
+	Storage StorageMode
+	// CompactionStrategy picks the segments merged together, a
+	// SizeTieredStrategy by default.
+	CompactionStrategy CompactionStrategy
+	// GarbageThreshold is the share of dead bytes that aren't shadowed, see
+	// SegmentStats.ReclaimableRatio, from which compaction rewrites a frozen log segment, and from which a
+	// SizeTieredStrategy rewrites a segment alone, 0.5 by default. Segments
+	// with less garbage are only rewritten when they're merged.
+	GarbageThreshold float64
+	// Retention keeps older versions of keys through compaction and merge
+	// for History, GetAt and GetAsOf. By default only the versions open
+	// transactions and iterators still read are kept.
+	Retention Retention
+	// CacheSize is how many bytes of keys and values Get keeps in a read
+	// cache, which also remembers the keys it didn't find. The least
+	// recently used ones are evicted first. The cache is disabled when it's
+	// zero. Values Get returns from the cache are shared and must not be
+	// modified.
+	CacheSize int
+}
+
+func (o Options) withDefaults() Options {
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = config.DefaultSegmentSizeThreshold
+	}
+	if o.CompactionInterval <= 0 {
+		o.CompactionInterval = config.DefaultCompactionInterval
+	}
+	if o.IndexFactory == nil {
+		o.IndexFactory = index.NewHashMapIndex
+		if o.Storage == LSMStorage {
+			o.IndexFactory = index.NewSkipListIndex
+		}
+	}
+	if o.GarbageThreshold <= 0 {
+		o.GarbageThreshold = config.DefaultGarbageThreshold
+	}
+	if o.CompactionStrategy == nil {
+		o.CompactionStrategy = NewSizeTieredStrategy()
+	}
+	if st, ok := o.CompactionStrategy.(*SizeTieredStrategy); ok {
+		// a copy, not to change the strategy of the caller
+		strategy := *st
+		strategy.garbageThreshold = o.GarbageThreshold
+		o.CompactionStrategy = &strategy
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	return o
+}
@@ -0,0 +1,250 @@
+package databaseexperiment
+
+import (
+	"database-experiment/index"
+	"errors"
+	"sync"
+)
+
+// A range tombstone deletes every key in [start, end) written before it with
+// a single RecordTypeRangeTombstone record, holding start as its key and end
+// as its RangeEnd. Range tombstones aren't part of the index of a segment,
+// every segment keeps a list of them that lookups consult besides the index.
+// Hint files and SSTable key blocks list them as entries of their start key
+// flagged with recordFlagRangeTombstone, their end is read from the record.
+
+var (
+	errInvalidRange = errors.New("range end must be after its start")
+)
+
+type rangeTombstone struct {
+	start string
+	// end is exclusive, empty means there is no upper bound
+	end    string
+	record index.Record
+}
+
+func (t rangeTombstone) covers(key string) bool {
+	return key >= t.start && (t.end == "" || key < t.end)
+}
+
+// rangeTombstones holds the range tombstones of a segment. A writable segment
+// shares them with the immutable segment it's frozen into.
+type rangeTombstones struct {
+	sync.RWMutex
+	list []rangeTombstone
+}
+
+func (r *rangeTombstones) add(tombstone rangeTombstone) {
+	r.Lock()
+	defer r.Unlock()
+	r.list = append(r.list, tombstone)
+}
+
+func (r *rangeTombstones) all() []rangeTombstone {
+	r.RLock()
+	defer r.RUnlock()
+	return append([]rangeTombstone(nil), r.list...)
+}
+
+// deletedAt returns the sequence number of the newest range tombstone that
+// covers key and is at most seq, zero when there is none.
+func (r *rangeTombstones) deletedAt(key string, seq uint64) uint64 {
+	r.RLock()
+	defer r.RUnlock()
+	var deletedAt uint64
+	for _, tombstone := range r.list {
+		if tombstone.record.Seq <= seq && tombstone.record.Seq > deletedAt && tombstone.covers(key) {
+			deletedAt = tombstone.record.Seq
+		}
+	}
+	return deletedAt
+}
+
+func (s *segment) rangeDeletedAt(key string, seq uint64) uint64 {
+	return s.ranges.deletedAt(key, seq)
+}
+
+func (s *segment) rangeTombstones() []rangeTombstone {
+	return s.ranges.all()
+}
+
+// newestCovering returns the sequence number of the newest of tombstones
+// that covers key, zero when none does.
+func newestCovering(tombstones []rangeTombstone, key string) uint64 {
+	var deletedAt uint64
+	for _, tombstone := range tombstones {
+		if tombstone.record.Seq > deletedAt && tombstone.covers(key) {
+			deletedAt = tombstone.record.Seq
+		}
+	}
+	return deletedAt
+}
+
+// addRangeTombstone adds the range tombstone row, stored at record, to the
+// segment.
+func (s *segment) addRangeTombstone(row DBRow, record index.Record) {
+	s.ranges.add(rangeTombstone{start: row.Key, end: row.RangeEnd, record: record})
+}
+
+// recoverRangeTombstone reads the end of the range tombstone stored at record
+// and adds it to the segment.
+func (s *segment) recoverRangeTombstone(start string, record index.Record) error {
+	row, err := s.readKeyAtOffset(start, record.Offset)
+	if err != nil {
+		return err
+	}
+	s.addRangeTombstone(row, record)
+	return nil
+}
+
+// recoverRangeTombstones collects the range tombstones of an SSTable from its
+// key blocks.
+func (r *immutableSegment) recoverRangeTombstones() error {
+	table, ok := r.indexStrategy.(*sstableIndex)
+	if !ok {
+		return nil
+	}
+	entries, err := table.rangeTombstones()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = r.recoverRangeTombstone(entry.key, entry.record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeDeletedAt returns the sequence number of the newest range tombstone in
+// segments that covers key and is at most seq, zero when there is none.
+func rangeDeletedAt(segments []Segment, key string, seq uint64) uint64 {
+	var deletedAt uint64
+	for _, seg := range segments {
+		if segDeletedAt := seg.rangeDeletedAt(key, seq); segDeletedAt > deletedAt {
+			deletedAt = segDeletedAt
+		}
+	}
+	return deletedAt
+}
+
+// findRowAt looks up the newest row of key with a sequence number of at most
+// seq in segments, ordered from the newest to the oldest. A row that a newer
+// range tombstone deletes is returned as a tombstone carrying the sequence
+// number of the range tombstone. Range tombstones are checked in every
+// segment, a rewrite that splits its output keeps a range tombstone only in
+// the segment its start key went to.
+func findRowAt(segments []Segment, key string, seq uint64) (DBRow, error) {
+	deletedAt := rangeDeletedAt(segments, key, seq)
+	for _, seg := range segments {
+		row, err := seg.ReadRowAt(key, seq)
+		if err == index.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return DBRow{}, err
+		}
+		if row.Seq < deletedAt {
+			return DBRow{Key: key, Type: RecordTypeTombstone, Seq: deletedAt}, nil
+		}
+		return row, nil
+	}
+	return DBRow{}, index.ErrKeyNotFound
+}
+
+// hasVersionBefore reports whether seg has a version older than seq of a key
+// in [start, end).
+func hasVersionBefore(seg Segment, start, end string, seq uint64) (bool, error) {
+	keys, err := segmentKeysInRange(seg, start, end)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		versions, err := seg.GetIndexStrategy().GetVersions(key)
+		if err == index.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if versions[0].Seq < seq {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// supersedeRange counts the versions of the keys in [start, end) that are
+// live in segments, the frozen segments when a range tombstone was written
+// to the current segment, as dead in shadows. Keys for which skip returns
+// true were already counted. It reports whether segments have a key in the
+// range at all.
+func (s *Segments) supersedeRange(segments []Segment, start, end string, skip func(key string) bool, shadows *rangeShadows) bool {
+	lists := make([][]string, 0, len(segments))
+	for _, seg := range segments {
+		keys, err := segmentKeysInRange(seg, start, end)
+		if err != nil {
+			s.logger.Printf("couldn't update the garbage of segment %s: %v\n", seg.GetId(), err)
+			continue
+		}
+		lists = append(lists, keys)
+	}
+	keys := mergeSortedKeys(lists)
+	for _, key := range keys {
+		if skip(key) {
+			continue
+		}
+		if seg, record, ok := s.newestLive(segments, key); ok {
+			shadows.supersede(seg.usage, key, record)
+		}
+	}
+	return len(keys) > 0
+}
+
+// supersedeRangeInBackground counts the versions the range tombstone [start,
+// end) written to seg at record deletes as dead, in seg and in the frozen
+// segments, in a goroutine so that the write doesn't wait for it. The frozen
+// segments are listed right away, seg may be frozen itself by the time the
+// goroutine runs.
+func (db *Database) supersedeRangeInBackground(seg *writableSegment, start, end string, record index.Record) {
+	frozen := db.frozenSegments.snapshot()
+	started := db.goInBackground(func() {
+		defer releaseSegments(frozen, db.opts.Logger)
+		seg.supersedeRange(start, end, record.Seq)
+		// the keys seg had before the range tombstone were counted when
+		// they were first written to it
+		deletesOlder := db.frozenSegments.supersedeRange(frozen, start, end, func(key string) bool {
+			return seg.shadowsBefore(key, record.Seq)
+		}, &seg.rangeShadows)
+		// rewrites keep the range tombstone while it deletes a version of a
+		// frozen segment
+		if deletesOlder {
+			seg.usage.shadow(0, record.Size)
+		}
+	})
+	if !started {
+		releaseSegments(frozen, db.opts.Logger)
+	}
+}
+
+// DeleteRange removes every key in [start, end) by writing a single range
+// tombstone. An empty end means there is no upper bound.
+func (db *Database) DeleteRange(start, end string) error {
+	if end != "" && end <= start {
+		return errInvalidRange
+	}
+	pmTotalWrites.Inc()
+	err := db.writeRows([]DBRow{{Key: start, RangeEnd: end, Type: RecordTypeRangeTombstone}}, false)
+	if err != nil {
+		db.opts.Logger.Printf("couldn't delete range [%s, %s) err is: %v\n", start, end, err)
+		return err
+	}
+	db.checkCurrentSegmentSizeInBackground()
+	return nil
+}
+
+// DeletePrefix removes every key starting with prefix.
+func (db *Database) DeletePrefix(prefix string) error {
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
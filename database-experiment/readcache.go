@@ -0,0 +1,116 @@
+package databaseexperiment
+
+import (
+	"database-experiment/cache"
+	"database-experiment/index"
+	"github.com/vmihailenco/msgpack/v5"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readCache keeps the newest version of the keys Get read from the segments,
+// and the keys it didn't find, so that hot keys are neither looked up nor
+// decoded again. Every write invalidates the keys it changes.
+type readCache struct {
+	values *cache.ShardedCache[string, cachedRead]
+	// lock orders filling the cache after invalidating it, a read that
+	// raced with a write doesn't fill the cache with what it overwrote
+	lock sync.Mutex
+}
+
+// cachedRead is what a read found for a key, found is false for a key that
+// doesn't exist.
+type cachedRead struct {
+	value interface{}
+	seq   uint64
+	found bool
+}
+
+const (
+	// cachedReadOverhead is what a cachedRead counts for besides its value.
+	cachedReadOverhead = 48
+	// readCacheShards is how many shards the read cache is split into, so
+	// concurrent hits on different keys rarely share a lock
+	readCacheShards = 16
+)
+
+func newReadCache(size int) *readCache {
+	return &readCache{values: cache.NewSharded(readCacheShards, cache.Config[string, cachedRead]{
+		MaxBytes: int64(size),
+		Size: func(key string, read cachedRead) int64 {
+			return int64(len(key)) + read.size()
+		},
+	}, nil)}
+}
+
+// size returns about how many bytes read takes in the cache.
+func (read cachedRead) size() int64 {
+	switch value := read.value.(type) {
+	case nil:
+		return cachedReadOverhead
+	case string:
+		return cachedReadOverhead + int64(len(value))
+	case []byte:
+		return cachedReadOverhead + int64(len(value))
+	}
+	encoded, err := msgpack.Marshal(read.value)
+	if err != nil {
+		return cachedReadOverhead
+	}
+	return cachedReadOverhead + int64(len(encoded))
+}
+
+// getCached is getVersionAt at the newest write, going through the read
+// cache when the database has one.
+func (db *Database) getCached(key string) (interface{}, uint64, error) {
+	if db.readCache == nil {
+		return db.getVersionAt(key, math.MaxUint64)
+	}
+	if read, ok := db.readCache.values.Get(key); ok {
+		pmCacheHits.Inc()
+		if !read.found {
+			return nil, 0, index.ErrKeyNotFound
+		}
+		return read.value, read.seq, nil
+	}
+	pmCacheMisses.Inc()
+
+	lastSeq := atomic.LoadUint64(&db.lastSeq)
+	row, err := db.lookup(key, math.MaxUint64)
+	if err != nil && err != index.ErrKeyNotFound {
+		return nil, 0, err
+	}
+	now := time.Now()
+	read := cachedRead{value: row.Value, seq: row.Seq, found: err == nil && !row.isTombstone() && !row.isExpired(now)}
+	// a value is cached until it expires, a key that wasn't found until
+	// it's written
+	var ttl time.Duration
+	if read.found && row.ExpiresAt != 0 {
+		ttl = time.Unix(0, row.ExpiresAt).Sub(now)
+	}
+	db.readCache.lock.Lock()
+	if atomic.LoadUint64(&db.lastSeq) == lastSeq {
+		db.readCache.values.SetWithTTL(key, read, ttl)
+	}
+	db.readCache.lock.Unlock()
+	if !read.found {
+		return nil, 0, index.ErrKeyNotFound
+	}
+	return read.value, read.seq, nil
+}
+
+// invalidate removes the keys rows write from the read cache, a range
+// tombstone empties it. It's called once rows are visible.
+func (c *readCache) invalidate(rows []DBRow) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, row := range rows {
+		if row.Type == RecordTypeRangeTombstone {
+			c.values.Clear()
+			return
+		}
+		c.values.Delete(row.Key)
+	}
+}
@@ -0,0 +1,213 @@
+package databaseexperiment
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"hash/crc32"
+	"io"
+)
+
+// Every record inside a segment is framed as:
+//
+//	| length (8 bytes) | crc32 of payload (4 bytes) | msgpack encoded DBRow |
+const (
+	recordLengthSize   = 8
+	recordChecksumSize = 4
+	recordHeaderSize   = recordLengthSize + recordChecksumSize
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptRecord is returned when a record can't be read back the way it
+// was written, either because its checksum doesn't match or because its
+// payload can't be decoded.
+type ErrCorruptRecord struct {
+	SegmentId string
+	Offset    int64
+	Reason    string
+}
+
+func (e *ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("corrupt record in segment %s at offset %d: %s", e.SegmentId, e.Offset, e.Reason)
+}
+
+func encodeRecord(row *DBRow) ([]byte, error) {
+	payload, err := msgpack.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint64(record, uint64(len(payload)))
+	binary.LittleEndian.PutUint32(record[recordLengthSize:], crc32.Checksum(payload, crcTable))
+	return append(record, payload...), nil
+}
+
+func parseRecordHeader(header []byte, segmentId string, offset, size int64) (uint64, uint32, error) {
+	recordLen := binary.LittleEndian.Uint64(header)
+	if recordLen == 0 {
+		return 0, 0, &ErrCorruptRecord{SegmentId: segmentId, Offset: offset, Reason: "empty record"}
+	}
+	if recordLen > uint64(size-offset-recordHeaderSize) {
+		return 0, 0, &ErrCorruptRecord{SegmentId: segmentId, Offset: offset, Reason: "record length exceeds segment size"}
+	}
+	return recordLen, binary.LittleEndian.Uint32(header[recordLengthSize:]), nil
+}
+
+func verifyRecord(payload []byte, checksum uint32, segmentId string, offset int64) error {
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return &ErrCorruptRecord{SegmentId: segmentId, Offset: offset, Reason: "checksum mismatch"}
+	}
+	return nil
+}
+
+// readRecord reads the record at offset and verifies its checksum. size is
+// the size of the whole segment file, records claiming to run past it are
+// reported as corrupt instead of being allocated.
+func readRecord(r io.ReaderAt, segmentId string, offset, size int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		if err == io.EOF {
+			return nil, &ErrCorruptRecord{SegmentId: segmentId, Offset: offset, Reason: "short record header"}
+		}
+		return nil, err
+	}
+	recordLen, checksum, err := parseRecordHeader(header, segmentId, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, recordLen)
+	if _, err := r.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, &ErrCorruptRecord{SegmentId: segmentId, Offset: offset, Reason: "short record payload"}
+		}
+		return nil, err
+	}
+	if err := verifyRecord(payload, checksum, segmentId, offset); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// recordScanner reads the records of a segment sequentially, verifying
+// every checksum on the way.
+type recordScanner struct {
+	r         *bufio.Reader
+	ra        io.ReaderAt
+	segmentId string
+	size      int64
+	offset    int64
+	header    []byte
+
+	recordOffset int64
+	payload      []byte
+	err          error
+	tornTail     bool
+}
+
+func newRecordScanner(r io.ReaderAt, segmentId string, start, size int64) *recordScanner {
+	return &recordScanner{
+		r:         bufio.NewReaderSize(io.NewSectionReader(r, start, size-start), 1<<20),
+		ra:        r,
+		segmentId: segmentId,
+		size:      size,
+		offset:    start,
+		header:    make([]byte, recordHeaderSize),
+	}
+}
+
+// Next advances to the next record. It returns false at the end of the
+// segment or on the first error, which is then available from Err.
+func (sc *recordScanner) Next() bool {
+	if sc.err != nil || sc.offset >= sc.size {
+		return false
+	}
+	sc.recordOffset = sc.offset
+	if _, err := io.ReadFull(sc.r, sc.header); err != nil {
+		sc.err = sc.readErr(err, "short record header")
+		return false
+	}
+	recordLen, checksum, err := parseRecordHeader(sc.header, sc.segmentId, sc.offset, sc.size)
+	if err != nil {
+		// a length running past the end is what a partially written payload
+		// looks like, unless it's a damaged length the records after it follow
+		sc.tornTail = binary.LittleEndian.Uint64(sc.header) != 0 && !sc.recordFollows(sc.offset+recordHeaderSize)
+		sc.err = err
+		return false
+	}
+	sc.payload = make([]byte, recordLen)
+	if _, err = io.ReadFull(sc.r, sc.payload); err != nil {
+		sc.err = sc.readErr(err, "short record payload")
+		return false
+	}
+	if sc.err = verifyRecord(sc.payload, checksum, sc.segmentId, sc.offset); sc.err != nil {
+		sc.tornTail = sc.offset+recordHeaderSize+int64(recordLen) == sc.size
+		return false
+	}
+	sc.offset += recordHeaderSize + int64(recordLen)
+	return true
+}
+
+// recordFollows reports whether a record that passes verification starts
+// anywhere between from and the end of the segment. It also reports true
+// when the rest of the segment can't be read, so that it's treated as
+// corrupt rather than cut off.
+func (sc *recordScanner) recordFollows(from int64) bool {
+	rest := make([]byte, sc.size-from)
+	if _, err := sc.ra.ReadAt(rest, from); err != nil && err != io.EOF {
+		return true
+	}
+	for i := 0; i+recordHeaderSize < len(rest); i++ {
+		recordLen := binary.LittleEndian.Uint64(rest[i:])
+		if recordLen == 0 || recordLen > uint64(len(rest)-i-recordHeaderSize) {
+			continue
+		}
+		payload := rest[i+recordHeaderSize : i+recordHeaderSize+int(recordLen)]
+		if crc32.Checksum(payload, crcTable) == binary.LittleEndian.Uint32(rest[i+recordLengthSize:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *recordScanner) readErr(err error, reason string) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		sc.tornTail = true
+		return &ErrCorruptRecord{SegmentId: sc.segmentId, Offset: sc.offset, Reason: reason}
+	}
+	return err
+}
+
+// TornTail reports whether the error returned by Err is an incomplete last
+// record, the way a crash in the middle of an append leaves the segment: a
+// record whose header or payload is cut off by the end of the segment with
+// nothing valid after it, or whose checksum fails and which ends the segment.
+func (sc *recordScanner) TornTail() bool {
+	return sc.tornTail
+}
+
+// Offset returns the offset of the record returned by the last call to Next.
+func (sc *recordScanner) Offset() int64 {
+	return sc.recordOffset
+}
+
+// Payload returns the verified payload of the current record.
+func (sc *recordScanner) Payload() []byte {
+	return sc.payload
+}
+
+func (sc *recordScanner) Err() error {
+	return sc.err
+}
+
+func decodeRecord(payload []byte, segmentId string, offset int64) (DBRow, error) {
+	var row DBRow
+	if err := msgpack.Unmarshal(payload, &row); err != nil {
+		return row, &ErrCorruptRecord{SegmentId: segmentId, Offset: offset, Reason: err.Error()}
+	}
+	if row.Key == "" && row.Type != RecordTypeBatch && row.Type != RecordTypeRangeTombstone {
+		return row, &ErrCorruptRecord{SegmentId: segmentId, Offset: offset, Reason: "empty key"}
+	}
+	return row, nil
+}
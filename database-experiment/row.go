@@ -1,8 +1,56 @@
 package databaseexperiment
 
+import "time"
+
+// RecordType tells apart the records stored in a segment.
+type RecordType uint8
+
+const (
+	// RecordTypeValue is a key and its value, the zero value so that records
+	// written before record types existed decode as values.
+	RecordTypeValue RecordType = iota
+	// RecordTypeBatch opens a batch, it's followed by BatchSize value records
+	// that are applied all together or not at all.
+	RecordTypeBatch
+	// RecordTypeTombstone deletes a key. It hides the older versions of the
+	// key in every segment, so compaction keeps it until no older segment
+	// has the key anymore.
+	RecordTypeTombstone
+	// RecordTypeRangeTombstone deletes every key from Key up to RangeEnd
+	// written before it.
+	RecordTypeRangeTombstone
+)
+
+// legacyTombstoneValue is the value that marked deletions before
+// RecordTypeTombstone existed.
+const legacyTombstoneValue = "$__TOMBSTONE__$"
+
 type DBRow struct {
 	Key          string
 	CreationTime int64
 	Offset       string
 	Value        interface{}
+	Type         RecordType `msgpack:",omitempty"`
+	BatchSize    int        `msgpack:",omitempty"`
+	// Seq is the database wide sequence number of the write, it orders the
+	// versions of a key and decides which of them a snapshot sees.
+	Seq uint64 `msgpack:",omitempty"`
+	// ExpiresAt is the unix time in nanoseconds the row expires at, zero
+	// means it never does.
+	ExpiresAt int64 `msgpack:",omitempty"`
+	// RangeEnd is the exclusive end of the keys a range tombstone deletes,
+	// empty means there is no upper bound.
+	RangeEnd string `msgpack:",omitempty"`
+}
+
+func (r *DBRow) isTombstone() bool {
+	if r.Type == RecordTypeTombstone {
+		return true
+	}
+	val, ok := r.Value.(string)
+	return ok && r.Type == RecordTypeValue && val == legacyTombstoneValue
+}
+
+func (r *DBRow) isExpired(now time.Time) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= now.UnixNano()
 }
@@ -0,0 +1,142 @@
+package databaseexperiment
+
+import (
+	"database-experiment/index"
+	"sort"
+)
+
+// Iterator walks the live keys of a range in ascending order, reading them
+// from a consistent snapshot taken when the scan started. It must be closed
+// when it's abandoned before Next returns false.
+type Iterator struct {
+	db       *Database
+	snapshot uint64
+	keys     []string
+	pos      int
+	key      string
+	value    interface{}
+	err      error
+	closed   bool
+}
+
+// Scan returns an iterator over the keys in [start, end). An empty end means
+// there is no upper bound.
+func (db *Database) Scan(start, end string) *Iterator {
+	it := &Iterator{db: db, snapshot: db.acquireSnapshot()}
+	segments := db.readSegments()
+	defer releaseSegments(segments, db.opts.Logger)
+	lists := make([][]string, len(segments))
+	for i, seg := range segments {
+		keys, err := segmentKeysInRange(seg, start, end)
+		if err != nil {
+			it.err = err
+			it.Close()
+			return it
+		}
+		lists[i] = keys
+	}
+	it.keys = mergeSortedKeys(lists)
+	return it
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix.
+func (db *Database) ScanPrefix(prefix string) *Iterator {
+	return db.Scan(prefix, prefixEnd(prefix))
+}
+
+// Next advances to the next live key, skipping deleted and expired ones. It
+// returns false when the range is exhausted or on the first error, which is
+// then available from Err.
+func (it *Iterator) Next() bool {
+	for !it.closed && it.pos < len(it.keys) {
+		key := it.keys[it.pos]
+		it.pos++
+		value, err := it.db.getAt(key, it.snapshot)
+		if err == index.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			break
+		}
+		it.key, it.value = key, value
+		return true
+	}
+	it.Close()
+	return false
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() interface{} {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the snapshot of the iterator, it's safe to call more than once.
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.db.releaseSnapshot(it.snapshot)
+}
+
+func segmentKeysInRange(seg Segment, start, end string) ([]string, error) {
+	switch idx := seg.GetIndexStrategy().(type) {
+	case *sstableIndex:
+		return idx.keysInRange(start, end)
+	case index.OrderedIndex:
+		return idx.KeysInRange(start, end), nil
+	}
+	var keys []string
+	for _, key := range seg.GetUniqueKeys() {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// mergeSortedKeys merges sorted key lists into one, without duplicates.
+func mergeSortedKeys(lists [][]string) []string {
+	var merged []string
+	positions := make([]int, len(lists))
+	for {
+		smallest := -1
+		for i, list := range lists {
+			if positions[i] < len(list) && (smallest == -1 || list[positions[i]] < lists[smallest][positions[smallest]]) {
+				smallest = i
+			}
+		}
+		if smallest == -1 {
+			return merged
+		}
+		key := lists[smallest][positions[smallest]]
+		for i, list := range lists {
+			if positions[i] < len(list) && list[positions[i]] == key {
+				positions[i]++
+			}
+		}
+		merged = append(merged, key)
+	}
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" when there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i > -1; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
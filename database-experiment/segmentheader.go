@@ -0,0 +1,188 @@
+package databaseexperiment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Every segment file starts with a fixed size header:
+//
+//	| magic (1) | version (1) | flags (1) | sequence (8) | crc32 of previous bytes (4) | zero padding |
+//
+// The low bit of flags marks compacted segments and the high four bits hold
+// the compaction level.
+// Records start right after the header, at offset headerLength.
+const (
+	headerLength = 1024
+	magicNumber  = 218
+
+	// legacySegmentVersion is the header-less format written before segment
+	// headers existed: records are an 8 byte length followed by msgpack,
+	// without a checksum.
+	legacySegmentVersion  = 0
+	currentSegmentVersion = 1
+	// sstableSegmentVersion segments hold their records sorted by key and end
+	// with the key blocks and block index described in sstable.go.
+	sstableSegmentVersion = 2
+
+	headerFlagCompacted = 1 << 0
+	headerLevelShift    = 4
+	// MaxSegmentLevel is the deepest level the header can record.
+	MaxSegmentLevel = 0xff >> headerLevelShift
+
+	headerSequenceOffset = 3
+	headerChecksumOffset = headerSequenceOffset + 8
+)
+
+var (
+	errNoSegmentHeader = errors.New("segment has no header")
+	// ErrCorruptSegmentHeader is returned when a segment starts with a header
+	// whose checksum doesn't match, the segment isn't opened.
+	ErrCorruptSegmentHeader = errors.New("segment header is corrupt")
+)
+
+type SegmentHeader struct {
+	Version     uint8
+	IsCompacted bool
+	// Sequence orders the segments by creation, a compacted or merged segment
+	// keeps the sequence of the newest segment it was built from.
+	Sequence uint64
+	// Level is the compaction level the segment was placed at, segments of a
+	// deeper level hold older data than those of the levels above it.
+	Level uint8
+}
+
+func (h SegmentHeader) encode() []byte {
+	b := make([]byte, headerLength)
+	b[0] = magicNumber
+	b[1] = h.Version
+	if h.IsCompacted {
+		b[2] |= headerFlagCompacted
+	}
+	b[2] |= h.Level << headerLevelShift
+	binary.LittleEndian.PutUint64(b[headerSequenceOffset:], h.Sequence)
+	binary.LittleEndian.PutUint32(b[headerChecksumOffset:], crc32.Checksum(b[:headerChecksumOffset], crcTable))
+	return b
+}
+
+// readSegmentHeader reads and validates the header of a segment file. It
+// returns errNoSegmentHeader for files written before headers existed, which
+// don't start with magicNumber, ErrCorruptSegmentHeader for a header that is
+// truncated or doesn't match its checksum and a descriptive error for
+// versions this build doesn't know about.
+func readSegmentHeader(file io.ReaderAt) (SegmentHeader, error) {
+	b := make([]byte, headerLength)
+	n, err := file.ReadAt(b, 0)
+	if n == 0 || b[0] != magicNumber {
+		if err == nil || err == io.EOF {
+			return SegmentHeader{}, errNoSegmentHeader
+		}
+		return SegmentHeader{}, err
+	}
+	if err == io.EOF {
+		return SegmentHeader{}, fmt.Errorf("%w: it's %d bytes long", ErrCorruptSegmentHeader, n)
+	}
+	if err != nil {
+		return SegmentHeader{}, err
+	}
+	if crc32.Checksum(b[:headerChecksumOffset], crcTable) != binary.LittleEndian.Uint32(b[headerChecksumOffset:]) {
+		return SegmentHeader{}, fmt.Errorf("%w: checksum mismatch", ErrCorruptSegmentHeader)
+	}
+	h := SegmentHeader{
+		Version:     b[1],
+		IsCompacted: b[2]&headerFlagCompacted != 0,
+		Level:       b[2] >> headerLevelShift,
+		Sequence:    binary.LittleEndian.Uint64(b[headerSequenceOffset:]),
+	}
+	if h.Version != currentSegmentVersion && h.Version != sstableSegmentVersion {
+		return SegmentHeader{}, fmt.Errorf("unsupported segment format version %d, this build reads versions %d and %d", h.Version, currentSegmentVersion, sstableSegmentVersion)
+	}
+	return h, nil
+}
+
+// IsSorted reports whether the segment is an SSTable.
+func (h SegmentHeader) IsSorted() bool {
+	return h.Version == sstableSegmentVersion
+}
+
+// migrateLegacySegment rewrites a header-less segment in the current format.
+// The new file is written next to the old one and renamed over it, so a
+// crash during migration leaves the legacy file untouched.
+func migrateLegacySegment(filePath string, sequence uint64, logger *log.Logger) error {
+	legacyFile, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer legacyFile.Close()
+	stat, err := legacyFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filePath + ".migrating"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fs.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer tmpFile.Close()
+
+	header := SegmentHeader{Version: currentSegmentVersion, Sequence: sequence}
+	if _, err = tmpFile.Write(header.encode()); err != nil {
+		return err
+	}
+
+	newOffset := int64(headerLength)
+	recordCount := 0
+	lengthBytes := make([]byte, 8)
+	for offset := int64(0); offset < stat.Size(); {
+		if _, err = legacyFile.ReadAt(lengthBytes, offset); err != nil {
+			logger.Printf("Dropped incomplete legacy record at offset %d of %s\n", offset, filePath)
+			break
+		}
+		recordLen := binary.LittleEndian.Uint64(lengthBytes)
+		if recordLen > uint64(stat.Size()-offset-8) {
+			logger.Printf("Dropped incomplete legacy record at offset %d of %s\n", offset, filePath)
+			break
+		}
+		payload := make([]byte, recordLen)
+		if _, err = legacyFile.ReadAt(payload, offset+8); err != nil {
+			return err
+		}
+		var row DBRow
+		if err = msgpack.Unmarshal(payload, &row); err != nil {
+			return fmt.Errorf("couldn't migrate %s, record at offset %d is unreadable: %w", filePath, offset, err)
+		}
+		row.Offset = formatOffset(newOffset)
+		record, err := encodeRecord(&row)
+		if err != nil {
+			return err
+		}
+		if _, err = tmpFile.Write(record); err != nil {
+			return err
+		}
+		newOffset += int64(len(record))
+		offset += 8 + int64(recordLen)
+		recordCount++
+	}
+
+	if err = tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(filePath)); err != nil {
+		return err
+	}
+	logger.Printf("Migrated legacy segment %s, RecordCount: %d\n", filePath, recordCount)
+	return nil
+}
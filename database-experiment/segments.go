@@ -2,40 +2,45 @@ package databaseexperiment
 
 import (
 	"database-experiment/index"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/vmihailenco/msgpack/v5"
 	"io"
 	"io/fs"
 	"log"
+	"math"
 	"os"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	headerLength = 1024
-	magicNumber  = 218
-)
-
-type SegmentHeader struct {
-	IsCompacted bool
-	Checksum    [256]byte
-}
-
 type Segment interface {
 	Read(key string) (interface{}, error)
+	// ReadRowAt returns the newest row of key whose Seq is at most seq,
+	// tombstones included.
+	ReadRowAt(key string, seq uint64) (DBRow, error)
+	// MaxSeq returns the highest sequence number written to the segment.
+	MaxSeq() uint64
+	// rangeDeletedAt returns the sequence number of the newest range
+	// tombstone of the segment that covers key and is at most seq, zero when
+	// there is none.
+	rangeDeletedAt(key string, seq uint64) uint64
+	rangeTombstones() []rangeTombstone
 	Write(key string, value interface{}) error
-	GetFileInfo() os.FileInfo
-	RecoverIndex()
+	GetFileInfo() (os.FileInfo, error)
+	RecoverIndex() error
+	WriteHint() error
 	GetUniqueKeys() []string
 	GetIndexStrategy() index.Index
 	GetId() string
+	GetHeader() SegmentHeader
+	// Close gives up the reference of the owner of the segment, its files
+	// are closed once no snapshot reads them anymore.
 	Close() error
+	acquire() bool
+	release() error
 }
 
 type segment struct {
@@ -43,10 +48,76 @@ type segment struct {
 	readFile      *os.File
 	indexStrategy index.Index
 	header        SegmentHeader
+	logger        *log.Logger
+	fileSize      int64
+	maxSeq        uint64
+	usage         *segmentUsage
+	ranges        *rangeTombstones
+	refs          *segmentRefs
+	// mayBeTorn is set on the segment that was appended to when the
+	// database stopped, RecoverIndex cuts a torn last record off it instead
+	// of failing
+	mayBeTorn bool
+}
+
+// segmentRefs counts the references to the files of a segment: the one of
+// its owner, the Segments it's listed in or the database for the current
+// segment, and one per snapshot still reading it. A writable segment shares
+// them with the immutable segment it's frozen into.
+type segmentRefs struct {
+	count int64
+	// close closes the files once the last reference is released
+	close func() error
+}
+
+func newSegmentRefs(close func() error) *segmentRefs {
+	return &segmentRefs{count: 1, close: close}
+}
+
+// acquire takes a reference, it fails once the files are closed.
+func (r *segmentRefs) acquire() bool {
+	for {
+		count := atomic.LoadInt64(&r.count)
+		if count < 1 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&r.count, count, count+1) {
+			return true
+		}
+	}
+}
+
+// release gives up a reference and closes the files with the last one.
+func (r *segmentRefs) release() error {
+	count := atomic.AddInt64(&r.count, -1)
+	if count < 0 {
+		return os.ErrClosed
+	}
+	if count == 0 {
+		return r.close()
+	}
+	return nil
 }
 
 func (s *segment) Close() error {
-	return s.readFile.Close()
+	return s.refs.release()
+}
+
+func (s *segment) acquire() bool {
+	return s.refs.acquire()
+}
+
+func (s *segment) release() error {
+	return s.refs.release()
+}
+
+// releaseSegments gives up the references a snapshot took.
+func releaseSegments(segments []Segment, logger *log.Logger) {
+	for _, seg := range segments {
+		if err := seg.release(); err != nil {
+			logger.Printf("couldn't close segment %s: %v\n", seg.GetId(), err)
+		}
+	}
 }
 
 func (s *segment) GetIndexStrategy() index.Index {
@@ -57,280 +128,695 @@ func (s *segment) GetUniqueKeys() []string {
 	return s.indexStrategy.AllKeys()
 }
 
-func (s *segment) RecoverIndex() {
+// RecoverIndex rebuilds the index from the segment's hint file when it has a
+// valid one, otherwise by scanning every record of the segment and writing a
+// hint for the next recovery. The scan stops at the first record that fails
+// verification and returns an *ErrCorruptRecord describing it.
+func (s *segment) RecoverIndex() error {
 	start := time.Now()
-	fmt.Println("Started to recover segment: ", s.id)
-	_, err := s.readFile.Seek(0, 0)
+	entries, maxSeq, err := readHintFile(s.readFile.Name(), s.size())
+	if err == nil {
+		for _, entry := range entries {
+			if !entry.rangeTombstone {
+				s.indexStrategy.Set(entry.key, entry.record)
+			} else if err = s.recoverRangeTombstone(entry.key, entry.record); err != nil {
+				return err
+			}
+		}
+		s.observeSeq(maxSeq)
+		s.logger.Printf("Recovered segment %s from hint file! KeyCount: %d, Time: %dms\n", s.id, len(entries), time.Now().Sub(start).Milliseconds())
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		s.logger.Printf("Ignoring hint file of segment %s: %v\n", s.id, err)
+	}
+
+	s.logger.Println("Started to recover segment: ", s.id)
+	lineCount, err := s.scanRows(s.indexTheLine)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	s.logger.Printf("Recovered segment! LineCount: %d, Time: %dms\n", lineCount, time.Now().Sub(start).Milliseconds())
+	if err = s.WriteHint(); err != nil {
+		s.logger.Printf("couldn't write hint file of segment %s: %v\n", s.id, err)
+	}
+	return nil
+}
 
-	lineCount := 0
-	for {
-		rowLenBytes := make([]byte, 8)
-		readCount, readErr := s.readFile.Read(rowLenBytes)
-		if readErr != nil {
-			if readErr == io.EOF {
-				break
+type scannedRow struct {
+	row  DBRow
+	size int64
+}
+
+// scanRows calls fn for every row of the segment in the order they were
+// written and returns how many rows it has seen. The rows of a batch are only
+// passed on once the whole batch has been read. A torn last record or batch
+// is cut off a segment that may be torn, any other record that fails
+// verification, and any torn one of another segment, is returned as an
+// *ErrCorruptRecord.
+func (s *segment) scanRows(fn func(row DBRow, size int64)) (int, error) {
+	scanner := newRecordScanner(s.readFile, s.id, headerLength, s.size())
+	rowCount := 0
+	var batch []scannedRow
+	batchRemaining := 0
+	batchOffset := int64(0)
+	for scanner.Next() {
+		row, err := decodeRecord(scanner.Payload(), s.id, scanner.Offset())
+		if err != nil {
+			return rowCount, err
+		}
+		size := int64(recordHeaderSize + len(scanner.Payload()))
+		switch {
+		case row.Type == RecordTypeBatch:
+			if batchRemaining > 0 {
+				return rowCount, &ErrCorruptRecord{SegmentId: s.id, Offset: scanner.Offset(), Reason: "batch started inside another batch"}
+			}
+			batch = batch[:0]
+			batchRemaining = row.BatchSize
+			batchOffset = scanner.Offset()
+		case batchRemaining > 0:
+			batch = append(batch, scannedRow{row: row, size: size})
+			batchRemaining--
+			if batchRemaining == 0 {
+				for i := range batch {
+					fn(batch[i].row, batch[i].size)
+				}
+				rowCount += len(batch)
 			}
-			panic(err)
+		default:
+			fn(row, size)
+			rowCount++
 		}
-		if readCount != 8 {
-			fmt.Println("Empty segment!")
-			return
+	}
+
+	err := scanner.Err()
+	if err == nil && batchRemaining == 0 {
+		return rowCount, nil
+	}
+	if err == nil && !s.mayBeTorn {
+		return rowCount, &ErrCorruptRecord{SegmentId: s.id, Offset: batchOffset, Reason: "incomplete batch"}
+	}
+	tornOffset := batchOffset
+	if err != nil {
+		var corruptErr *ErrCorruptRecord
+		if !s.mayBeTorn || !errors.As(err, &corruptErr) || !(scanner.TornTail() || s.isZeroFilledFrom(corruptErr.Offset)) {
+			return rowCount, err
+		}
+		if batchRemaining == 0 {
+			tornOffset = corruptErr.Offset
 		}
-		recordLen := binary.LittleEndian.Uint64(rowLenBytes)
-		recordBytes := make([]byte, recordLen)
+	}
+	return rowCount, s.truncate(tornOffset)
+}
 
-		_, readErr = s.readFile.Read(recordBytes)
-		if readErr != nil {
-			if readErr == io.EOF {
-				break
+// isZeroFilledFrom reports whether every byte from offset to the end of the
+// segment is zero, which is how a file system can leave space that was
+// allocated but never written before a crash.
+func (s *segment) isZeroFilledFrom(offset int64) bool {
+	buf := make([]byte, 64*1024)
+	for offset < s.size() {
+		n, err := s.readFile.ReadAt(buf, offset)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
 			}
-			panic(readErr)
 		}
+		if err != nil {
+			return err == io.EOF
+		}
+		offset += int64(n)
+	}
+	return true
+}
 
-		s.indexTheLine(s.id, recordBytes)
-		lineCount++
+// truncate drops everything after offset, used to cut off a torn last record
+// so the segment ends at a record boundary again.
+func (s *segment) truncate(offset int64) error {
+	file, err := os.OpenFile(s.readFile.Name(), os.O_WRONLY, fs.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = file.Truncate(offset); err != nil {
+		return err
 	}
-	fmt.Printf("Recovered segment! LineCount: %d, Time: %dms\n", lineCount, time.Now().Sub(start).Milliseconds())
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	dropped := s.size() - offset
+	atomic.StoreInt64(&s.fileSize, offset)
+	s.logger.Printf("Truncated torn tail of segment %s at offset %d, dropped %d bytes\n", s.id, offset, dropped)
+	return nil
+}
+
+// WriteHint writes the hint file for the current contents of the index.
+func (s *segment) WriteHint() error {
+	return writeHintFile(s.readFile.Name(), s.size(), s.MaxSeq(), s.indexStrategy, s.ranges.all())
+}
+
+// removeSegmentFiles removes the segment file id and its hint file.
+func removeSegmentFiles(dir, id string) error {
+	path := getFileAbsolutePath(dir, id)
+	for _, sidecar := range []string{hintFilePath(path), bloomFilePath(path)} {
+		if err := os.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Remove(path)
 }
 
 func (s *segment) GetId() string {
 	return s.id
 }
 
-func (s *segment) indexTheLine(sid string, line []byte) {
-	var row DBRow
-	unmarshalErr := msgpack.Unmarshal(line, &row)
-	if unmarshalErr != nil {
-		fmt.Println("couldn't unmarshal the row", unmarshalErr, line, sid)
-		panic(string(line))
-	}
-	if row.Key == "" {
-		fmt.Println("data is corrupted!")
-		return
-	}
-	if val, ok := row.Value.(string); ok == true && val == tombstoneValue {
-		fmt.Println("tombstone")
-		s.indexStrategy.Delete(row.Key)
-		return
-	}
-	s.indexStrategy.Set(row.Key, row.Offset, row.CreationTime)
+func (s *segment) GetHeader() SegmentHeader {
+	return s.header
 }
 
-func (s *segment) setSegmentHeader() {
-	b := make([]byte, headerLength, headerLength)
-	readCount, err := s.readFile.Read(b)
-	if err != nil {
-		panic(err)
-	}
-	if readCount != headerLength {
-		panic("read count is lower than header length")
-	}
+func (s *segment) size() int64 {
+	return atomic.LoadInt64(&s.fileSize)
+}
 
-	if b[0] != magicNumber {
-		panic("wrong magic number!")
-	}
+func (s *segment) MaxSeq() uint64 {
+	return atomic.LoadUint64(&s.maxSeq)
+}
 
-	h := SegmentHeader{}
+func (s *segment) observeSeq(seq uint64) {
+	for {
+		current := atomic.LoadUint64(&s.maxSeq)
+		if seq <= current || atomic.CompareAndSwapUint64(&s.maxSeq, current, seq) {
+			return
+		}
+	}
+}
 
-	if b[1]&1 != 1 {
-		h.IsCompacted = true
+func (s *segment) indexTheLine(row DBRow, size int64) {
+	s.observeSeq(row.Seq)
+	record := index.Record{
+		Offset:       row.Offset,
+		Size:         size,
+		CreationTime: row.CreationTime,
+		Seq:          row.Seq,
+		Tombstone:    row.isTombstone(),
+		ExpiresAt:    row.ExpiresAt,
+	}
+	if row.Type == RecordTypeRangeTombstone {
+		s.addRangeTombstone(row, record)
+		return
 	}
+	// tombstones are indexed too, they hide the key in older segments
+	s.indexStrategy.Set(row.Key, record)
 }
 
-func newSegment(id string, file *os.File, indexStrategy index.Index) *segment {
+func newSegment(id string, file *os.File, header SegmentHeader, indexStrategy index.Index, logger *log.Logger) *segment {
 	return &segment{
 		id:            id,
 		readFile:      file,
+		header:        header,
 		indexStrategy: indexStrategy,
+		logger:        logger,
+		usage:         newSegmentUsage(),
+		ranges:        &rangeTombstones{},
+		refs:          newSegmentRefs(file.Close),
 	}
 }
 
+func formatOffset(offset int64) string {
+	return strconv.FormatInt(offset, 16)
+}
+
 type immutableSegment struct {
 	segment
+	// filter holds the *bloomFilter of the segment's keys once it's built
+	filter atomic.Value
+
+	keyRangeOnce sync.Once
+	keyRange     segmentKeyRange
+}
+
+// mayContain consults the Bloom filter of the segment, a segment without one
+// may contain any key.
+func (r *immutableSegment) mayContain(key string) bool {
+	filter, ok := r.filter.Load().(*bloomFilter)
+	if !ok {
+		return true
+	}
+	if !filter.MayContain(key) {
+		pmBloomSkips.Inc()
+		return false
+	}
+	return true
+}
+
+// lookup finds the newest version of key at or below seq, counting the
+// lookups the Bloom filter failed to rule out as false positives.
+func (r *immutableSegment) lookup(key string, seq uint64) (index.Record, error) {
+	if !r.mayContain(key) {
+		return index.Record{}, index.ErrKeyNotFound
+	}
+	record, err := r.indexStrategy.GetRecordAt(key, seq)
+	if err == index.ErrKeyNotFound && r.filter.Load() != nil {
+		// only newer versions than seq is a miss but not a false positive
+		if _, latestErr := r.indexStrategy.GetRecord(key); latestErr == index.ErrKeyNotFound {
+			pmBloomFalsePositives.Inc()
+		}
+	}
+	return record, err
+}
+
+// RecoverIndex recovers the index and then the Bloom filter of the segment,
+// building the filter again when its file is missing or stale.
+func (r *immutableSegment) RecoverIndex() error {
+	if !r.header.IsSorted() {
+		if err := r.segment.RecoverIndex(); err != nil {
+			return err
+		}
+	} else if err := r.recoverRangeTombstones(); err != nil {
+		return err
+	}
+	filter, err := readBloomFile(r.readFile.Name(), r.size())
+	if err == nil {
+		r.filter.Store(filter)
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		r.logger.Printf("Ignoring bloom file of segment %s: %v\n", r.id, err)
+	}
+	r.buildFilter()
+	return nil
+}
+
+// buildFilter builds the Bloom filter from the index of the segment and
+// persists it next to the segment. The filter is used even if it can't be
+// persisted.
+func (r *immutableSegment) buildFilter() {
+	keys := r.GetUniqueKeys()
+	filter := newBloomFilter(len(keys))
+	for _, key := range keys {
+		filter.Add(key)
+	}
+	r.filter.Store(filter)
+	if err := writeBloomFile(r.readFile.Name(), r.size(), filter); err != nil {
+		r.logger.Printf("couldn't write bloom file of segment %s: %v\n", r.id, err)
+	}
 }
 
 func (r *immutableSegment) Write(string, interface{}) error {
-	panic("Immutable segment doesn't support writes!")
+	return errSegmentIsImmutable
 }
 
 func (r *immutableSegment) Read(key string) (interface{}, error) {
-	offset, err := r.indexStrategy.Get(key)
+	row, err := r.ReadRowAt(key, math.MaxUint64)
 	if err != nil {
-		return "", err
-	}
-	recordBytes := r.readRecordAtOffset(offset)
-	var row DBRow
-	unmarshalErr := msgpack.Unmarshal(recordBytes, &row)
-	if unmarshalErr != nil {
 		return nil, err
 	}
-	if row.Key != key {
-		return "", errors.New("data is corrupted")
-	}
 	return row.Value, nil
 }
 
-func (s *segment) readRecordAtOffset(offsetStr string) []byte {
-	offset, _ := strconv.ParseInt(offsetStr, 16, 0)
-	_, err := s.readFile.Seek(offset, 0)
+func (r *immutableSegment) ReadRowAt(key string, seq uint64) (DBRow, error) {
+	record, err := r.lookup(key, seq)
 	if err != nil {
-		log.Fatal(err)
+		return DBRow{}, err
 	}
-	rowLenBytes := make([]byte, 8)
-	_, readErr := s.readFile.Read(rowLenBytes)
-	if readErr != nil {
-		panic(err)
-	}
-	recordLen := binary.LittleEndian.Uint64(rowLenBytes)
-	recordBytes := make([]byte, recordLen)
+	return r.readKeyAtOffset(key, record.Offset)
+}
 
-	_, readErr = s.readFile.Read(recordBytes)
-	if readErr != nil {
-		panic(readErr)
+func (s *segment) readValueAtOffset(key, offsetStr string) (interface{}, error) {
+	row, err := s.readKeyAtOffset(key, offsetStr)
+	if err != nil {
+		return nil, err
 	}
+	return row.Value, nil
+}
 
-	return recordBytes
+// readKeyAtOffset reads the row at offsetStr and checks it belongs to key.
+func (s *segment) readKeyAtOffset(key, offsetStr string) (DBRow, error) {
+	offset, err := strconv.ParseInt(offsetStr, 16, 64)
+	if err != nil {
+		return DBRow{}, err
+	}
+	row, err := s.readRowAtOffset(offset)
+	if err != nil {
+		return DBRow{}, err
+	}
+	if row.Key != key {
+		return DBRow{}, &ErrCorruptRecord{SegmentId: s.id, Offset: offset, Reason: "record belongs to another key"}
+	}
+	return row, nil
 }
 
-func NewImmutableSegment(filePath string, indexStrategy index.Index) Segment {
-	isNewFile := false
-	if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
-		isNewFile = true
+func (s *segment) readRowAtOffset(offset int64) (DBRow, error) {
+	payload, err := readRecord(s.readFile, s.id, offset, s.size())
+	if err != nil {
+		return DBRow{}, err
 	}
-	file, fileErr := os.OpenFile(filePath, os.O_CREATE|os.O_RDONLY, fs.ModePerm)
-	if fileErr != nil {
-		panic(fileErr)
+	return decodeRecord(payload, s.id, offset)
+}
+
+// NewImmutableSegment opens an existing segment file for reading. Files
+// without a header are reported with errNoSegmentHeader and have to be
+// migrated first.
+func NewImmutableSegment(filePath string, indexStrategy index.Index, logger *log.Logger) (Segment, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
 	}
 	stat, err := file.Stat()
 	if err != nil {
-		return nil
+		file.Close()
+		return nil, err
 	}
-	s := &immutableSegment{*newSegment(stat.Name(), file, indexStrategy)}
-	if isNewFile {
-		// s.setSegmentHeader()
+	header, err := readSegmentHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("couldn't open segment %s: %w", stat.Name(), err)
 	}
-
-	return s
+	if header.IsSorted() {
+		// an SSTable brings its own index, it doesn't have to be recovered
+		table, err := openSSTableIndex(file, stat.Name(), stat.Size(), logger)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		indexStrategy = table
+	}
+	s := &immutableSegment{segment: *newSegment(stat.Name(), file, header, indexStrategy, logger)}
+	atomic.StoreInt64(&s.fileSize, stat.Size())
+	if table, ok := indexStrategy.(*sstableIndex); ok {
+		s.maxSeq = table.maxSeq
+	}
+	return s, nil
 }
 
 type writableSegment struct {
 	wLock sync.Mutex
 	segment
-	rLock sync.Mutex
 	wFile *os.File
+	// indexLock makes the index updates of one write visible all at once
+	indexLock sync.RWMutex
+	// onFirstWrite is called with the keys written to the segment for the
+	// first time, after they became visible. It reports whether a frozen
+	// segment has a version of the key, a tombstone then still hides it.
+	onFirstWrite func(key string) bool
+	// onRangeDelete is called with the range and the record of every range
+	// tombstone written to the segment once it's visible, it must not hold
+	// up the write with the versions the tombstone deletes
+	onRangeDelete func(start, end string, record index.Record)
+	// rangeShadows counts the versions the range tombstones of the segment
+	// deleted in the frozen segments
+	rangeShadows rangeShadows
 }
 
 func (w *writableSegment) getImmutableSegment() *immutableSegment {
-	return &immutableSegment{
-		segment: *newSegment(w.id, w.readFile, w.indexStrategy),
+	s := &immutableSegment{
+		segment: *newSegment(w.id, w.readFile, w.header, w.indexStrategy, w.logger),
 	}
+	atomic.StoreInt64(&s.fileSize, w.size())
+	s.maxSeq = w.MaxSeq()
+	s.usage = w.usage
+	s.ranges = w.ranges
+	s.refs = w.refs
+	return s
 }
 
-func (s *segment) GetFileInfo() os.FileInfo {
-	fInfo, err := s.readFile.Stat()
-	if err != nil {
-		panic(err)
-	}
-	return fInfo
+func (s *segment) GetFileInfo() (os.FileInfo, error) {
+	return s.readFile.Stat()
 }
 
 func (w *writableSegment) Write(key string, value interface{}) error {
+	return w.writeRows([]DBRow{{Key: key, Value: value}}, false)
+}
+
+// writeRows appends rows with a single write and then makes all of them
+// visible to readers at once. With batch set the rows are preceded by a batch
+// record, so that recovery applies either all of them or none. Rows without a
+// creation time are stamped with the current one.
+func (w *writableSegment) writeRows(rows []DBRow, batch bool) error {
 	w.wLock.Lock()
 	defer w.wLock.Unlock()
 	offset, err := w.wFile.Seek(0, 2)
 	if err != nil {
 		return err
 	}
-	offsetStr := strconv.FormatInt(offset, 16)
-	dbRow := DBRow{
-		Key:          key,
-		CreationTime: time.Now().Unix(),
-		Value:        value,
-		Offset:       offsetStr,
+	creationTime := time.Now().Unix()
+	var buf []byte
+	if batch {
+		buf, err = encodeRecord(&DBRow{Type: RecordTypeBatch, CreationTime: creationTime, BatchSize: len(rows)})
+		if err != nil {
+			return err
+		}
 	}
-	rowBytes, err := msgpack.Marshal(&dbRow)
-	if err != nil {
-		return err
+	batchRecordSize := len(buf)
+	records := make([]index.Record, len(rows))
+	for i := range rows {
+		recordOffset := formatOffset(offset + int64(len(buf)))
+		if rows[i].CreationTime == 0 {
+			rows[i].CreationTime = creationTime
+		}
+		rows[i].Offset = recordOffset
+		record, err := encodeRecord(&rows[i])
+		if err != nil {
+			return err
+		}
+		records[i] = index.Record{
+			Offset:       recordOffset,
+			Size:         int64(len(record)),
+			CreationTime: rows[i].CreationTime,
+			Seq:          rows[i].Seq,
+			Tombstone:    rows[i].isTombstone(),
+			ExpiresAt:    rows[i].ExpiresAt,
+		}
+		buf = append(buf, record...)
 	}
-	rowLength := make([]byte, 8)
-	binary.LittleEndian.PutUint64(rowLength, uint64(len(rowBytes)))
-	_, err = w.wFile.Write(append(rowLength, rowBytes...))
-	if err != nil {
+	if _, err = w.wFile.Write(buf); err != nil {
+		// don't leave a partial record for the next write to append after
+		if truncateErr := w.wFile.Truncate(offset); truncateErr != nil {
+			w.logger.Printf("couldn't truncate segment %s after a failed write: %v\n", w.id, truncateErr)
+		}
 		return err
 	}
-	w.indexStrategy.Set(key, offsetStr, dbRow.CreationTime)
+	atomic.StoreInt64(&w.fileSize, offset+int64(len(buf)))
+	var firstWrites []string
+	w.indexLock.Lock()
+	// the batch record holds no key
+	w.usage.addDead(0, int64(batchRecordSize))
+	for i := range rows {
+		w.observeSeq(rows[i].Seq)
+		if rows[i].Type == RecordTypeRangeTombstone {
+			w.deleteRange(rows[i], records[i])
+			continue
+		}
+		if previous, err := w.indexStrategy.GetRecord(rows[i].Key); err == nil {
+			if w.isLive(rows[i].Key, previous) {
+				w.usage.supersede(rows[i].Key, previous, false)
+			}
+			w.usage.reclaimTombstone(rows[i].Key)
+		} else if w.ranges.deletedAt(rows[i].Key, math.MaxUint64) == 0 {
+			// a key a range tombstone of the segment covers has been counted
+			firstWrites = append(firstWrites, rows[i].Key)
+		}
+		w.indexStrategy.Set(rows[i].Key, records[i])
+		if records[i].Tombstone {
+			w.usage.addDead(1, records[i].Size)
+		} else {
+			w.usage.addLive(rows[i].Key, records[i])
+		}
+	}
+	w.indexLock.Unlock()
+	if w.onFirstWrite != nil {
+		for _, key := range firstWrites {
+			if !w.onFirstWrite(key) {
+				continue
+			}
+			w.indexLock.RLock()
+			record, err := w.indexStrategy.GetRecord(key)
+			w.indexLock.RUnlock()
+			if err == nil && record.Tombstone {
+				w.usage.shadowTombstone(key, record.Size)
+			}
+		}
+	}
+	if w.onRangeDelete != nil {
+		for i, row := range rows {
+			if row.Type == RecordTypeRangeTombstone {
+				w.onRangeDelete(row.Key, row.RangeEnd, records[i])
+			}
+		}
+	}
 	return nil
 }
 
-func (w *writableSegment) Read(key string) (interface{}, error) {
-	offset, err := w.indexStrategy.Get(key)
+// isLive reports whether record, the newest version of key in the segment,
+// is live. The caller holds indexLock.
+func (w *writableSegment) isLive(key string, record index.Record) bool {
+	return !record.Tombstone && w.ranges.deletedAt(key, math.MaxUint64) < record.Seq
+}
+
+// deleteRange adds the range tombstone row, stored at record. The versions it
+// deletes in the segment are counted as dead by supersedeRange. The caller
+// holds indexLock.
+func (w *writableSegment) deleteRange(row DBRow, record index.Record) {
+	w.usage.addDead(0, record.Size)
+	w.addRangeTombstone(row, record)
+}
+
+// supersedeRange counts the versions of the keys in [start, end) that were
+// live in the segment when the range tombstone at seq was written as dead.
+// The writes after it don't count the versions it deleted again.
+func (w *writableSegment) supersedeRange(start, end string, seq uint64) {
+	w.indexLock.RLock()
+	keys, err := segmentKeysInRange(w, start, end)
+	w.indexLock.RUnlock()
 	if err != nil {
-		return "", err
+		w.logger.Printf("couldn't update the garbage of segment %s: %v\n", w.id, err)
+		return
 	}
-	w.rLock.Lock()
-	line := w.readRecordAtOffset(offset)
-	w.rLock.Unlock()
-	var row DBRow
-	unmarshalErr := msgpack.Unmarshal(line, &row)
-	if unmarshalErr != nil {
-		return nil, unmarshalErr
+	for _, key := range keys {
+		w.indexLock.RLock()
+		previous, err := w.indexStrategy.GetRecordAt(key, seq-1)
+		live := err == nil && !previous.Tombstone && w.ranges.deletedAt(key, seq-1) < previous.Seq
+		w.indexLock.RUnlock()
+		if live {
+			w.usage.supersede(key, previous, false)
+		}
 	}
-	if row.Key != key {
-		return "", errors.New("data is corrupted")
+}
+
+// shadows reports whether the segment has a version of key or a range
+// tombstone that covers it.
+func (w *writableSegment) shadows(key string) bool {
+	return w.shadowsBefore(key, math.MaxUint64)
+}
+
+// shadowsBefore is shadows for the writes made before sequence number seq.
+func (w *writableSegment) shadowsBefore(key string, seq uint64) bool {
+	w.indexLock.RLock()
+	defer w.indexLock.RUnlock()
+	_, err := w.indexStrategy.GetRecordAt(key, seq-1)
+	return err == nil || w.ranges.deletedAt(key, seq-1) > 0
+}
+
+func (w *writableSegment) Sync() error {
+	return w.wFile.Sync()
+}
+
+func (w *writableSegment) Read(key string) (interface{}, error) {
+	w.indexLock.RLock()
+	offsetStr, err := w.indexStrategy.Get(key)
+	w.indexLock.RUnlock()
+	if err != nil {
+		return "", err
 	}
-	return row.Value, nil
+	return w.readValueAtOffset(key, offsetStr)
 }
 
-func (w *writableSegment) Close() error {
-	w.readFile.Close()
-	w.wFile.Close()
-	return nil
+func (w *writableSegment) ReadRowAt(key string, seq uint64) (DBRow, error) {
+	w.indexLock.RLock()
+	record, err := w.indexStrategy.GetRecordAt(key, seq)
+	w.indexLock.RUnlock()
+	if err != nil {
+		return DBRow{}, err
+	}
+	return w.readKeyAtOffset(key, record.Offset)
 }
 
-func NewWritableSegment(filePath string, indexStrategy index.Index) *writableSegment {
-	file, fileErr := os.OpenFile(filePath, os.O_CREATE|os.O_RDONLY, fs.ModePerm)
-	if fileErr != nil {
-		panic(fileErr)
+// NewWritableSegment opens filePath for appending. A new file gets header
+// written at its start, an existing one keeps the header it already has.
+func NewWritableSegment(filePath string, header SegmentHeader, indexStrategy index.Index, logger *log.Logger) (*writableSegment, error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDONLY, fs.ModePerm)
+	if err != nil {
+		return nil, err
 	}
 	stat, err := file.Stat()
 	if err != nil {
-		return nil
+		file.Close()
+		return nil, err
 	}
-	ws := &writableSegment{
-		segment: *newSegment(stat.Name(), file, indexStrategy),
+	wFile, err := os.OpenFile(filePath, os.O_WRONLY, fs.ModePerm)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	size := stat.Size()
+	if size == 0 {
+		header.Version = currentSegmentVersion
+		_, err = wFile.Write(header.encode())
+		size = headerLength
+	} else {
+		header, err = readSegmentHeader(file)
 	}
-	ws.wFile, fileErr = os.OpenFile(filePath, os.O_WRONLY, fs.ModePerm)
-	if fileErr != nil {
-		panic(fileErr)
+	if err != nil {
+		file.Close()
+		wFile.Close()
+		return nil, err
+	}
+	ws := &writableSegment{
+		segment: *newSegment(stat.Name(), file, header, indexStrategy, logger),
+		wFile:   wFile,
 	}
+	atomic.StoreInt64(&ws.fileSize, size)
+	ws.refs = newSegmentRefs(func() error {
+		readErr := file.Close()
+		if err := wFile.Close(); err != nil {
+			return err
+		}
+		return readErr
+	})
 
-	return ws
+	return ws, nil
 }
 
 var (
-	errKeyIsNotInSegments = errors.New("couldn't find the key inside segments")
+	errSegmentIsImmutable = errors.New("immutable segment doesn't support writes")
 )
 
 type Segments struct {
+	dir          string
+	newIndex     func() index.Index
+	logger       *log.Logger
 	segmentsLock sync.Mutex
 	segments     []Segment
 	sync.Mutex
-	compactionInProgress bool
-	mergeInProgress      bool
+	// compactionInProgress is 1 while Compaction runs
+	compactionInProgress int32
+	// mergeInProgress is 1 from when a background merge is claimed until it
+	// is done, see claimMerge
+	mergeInProgress int32
+	// sorted makes compaction and merge write SSTables, it's set in LSM mode
+	sorted   bool
+	strategy CompactionStrategy
+	// retentionFloor returns the oldest sequence number an open snapshot
+	// reads at. Rewrites keep every version newer than it and the newest
+	// version at or below it, when it's nil only the newest version is kept.
+	retentionFloor func() uint64
+	// inCurrentSegment reports whether the current segment, which is newer
+	// than all of the frozen ones, has a version of a key or a range
+	// tombstone that covers it.
+	inCurrentSegment func(key string) bool
+	// retention keeps older versions through rewrites
+	retention Retention
+	// garbageThreshold is the garbage ratio from which Compaction rewrites a
+	// log segment
+	garbageThreshold float64
+	// manifest records the live segments, the frozen ones and the current one
+	manifest *manifest
 }
 
 func (s *Segments) IsCompactionInProgress() bool {
-	return s.compactionInProgress
+	return atomic.LoadInt32(&s.compactionInProgress) == 1
 }
 
+// Add registers seg, keeping the segments ordered from oldest to newest.
 func (s *Segments) Add(seg Segment) {
 	s.segmentsLock.Lock()
 	pmSegmentCount.Inc()
 	defer s.segmentsLock.Unlock()
-	s.segments = append(s.segments, seg)
+	i := sort.Search(len(s.segments), func(i int) bool {
+		return segmentLess(seg, s.segments[i])
+	})
+	s.segments = append(s.segments, nil)
+	copy(s.segments[i+1:], s.segments[i:])
+	s.segments[i] = seg
 }
 
 func (s *Segments) Delete(id string) error {
@@ -353,141 +839,697 @@ func (s *Segments) Delete(id string) error {
 	return nil
 }
 
-func (s *Segments) Recover() {
+func (s *Segments) Close() error {
+	s.segmentsLock.Lock()
+	defer s.segmentsLock.Unlock()
+	var firstErr error
+	for i := range s.segments {
+		if immutable, ok := s.segments[i].(*immutableSegment); ok {
+			immutable.usage.release()
+		}
+		if err := s.segments[i].Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("couldn't close segment %s: %w", s.segments[i].GetId(), err)
+		}
+	}
+	if s.manifest != nil {
+		if err := s.manifest.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("couldn't close manifest: %w", err)
+		}
+	}
+	return firstErr
+}
+
+func (s *Segments) Recover() error {
+	if newest := s.newestLogSegment(); newest != nil {
+		newest.mayBeTorn = true
+	}
 	var wg sync.WaitGroup
+	errs := make([]error, len(s.segments))
 	for i := range s.segments {
 		wg.Add(1)
 		go func(index int) {
-			s.segments[index].RecoverIndex()
+			errs[index] = s.segments[index].RecoverIndex()
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
-	fmt.Println("Segments recovering is done!")
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(s.segments) - 1; i > -1; i-- {
+		if seg, ok := s.segments[i].(*immutableSegment); ok {
+			if err := s.initUsage(seg, s.segments[:i], s.segments[i+1:]); err != nil {
+				return fmt.Errorf("couldn't count the garbage of segment %s: %w", seg.GetId(), err)
+			}
+		}
+	}
+	s.logger.Println("Segments recovering is done!")
+	return nil
+}
+
+// newestLogSegment returns the log segment with the highest sequence that
+// isn't compacted, the one that was being appended to when the database
+// stopped. Every other segment was written completely.
+func (s *Segments) newestLogSegment() *immutableSegment {
+	var newest *immutableSegment
+	for _, seg := range s.segments {
+		immutable, ok := seg.(*immutableSegment)
+		if !ok || immutable.header.IsCompacted || immutable.header.Version == sstableSegmentVersion {
+			continue
+		}
+		if newest == nil || immutable.header.Sequence > newest.header.Sequence {
+			newest = immutable
+		}
+	}
+	return newest
 }
 
 func (s *Segments) Sort() {
-	sort.Slice(s.segments, func(i, j int) bool {
-		return s.segments[i].GetFileInfo().Name() < s.segments[j].GetFileInfo().Name()
+	sort.SliceStable(s.segments, func(i, j int) bool {
+		return segmentLess(s.segments[i], s.segments[j])
 	})
 }
 
+// segmentLess orders segments from oldest to newest: from the deepest level
+// to level 0 and by sequence within a level.
+func segmentLess(a, b Segment) bool {
+	if a.GetHeader().Level != b.GetHeader().Level {
+		return a.GetHeader().Level > b.GetHeader().Level
+	}
+	if a.GetHeader().Sequence != b.GetHeader().Sequence {
+		return a.GetHeader().Sequence < b.GetHeader().Sequence
+	}
+	return a.GetId() < b.GetId()
+}
+
+// snapshot returns the segments from the oldest to the newest, holding a
+// reference to each of them that the caller gives up with releaseSegments.
+// Segments listed here always have the reference of Segments, taking another
+// one can't fail.
+func (s *Segments) snapshot() []Segment {
+	s.segmentsLock.Lock()
+	defer s.segmentsLock.Unlock()
+	for _, seg := range s.segments {
+		seg.acquire()
+	}
+	return append([]Segment(nil), s.segments...)
+}
+
+// FindKeyInsideSegments looks key up from the newest segment to the oldest
+// and returns index.ErrKeyNotFound when none of them has it.
 func (s *Segments) FindKeyInsideSegments(key string) (interface{}, error) {
-	for i := len(s.segments) - 1; i > -1; i-- {
-		data, err := s.segments[i].Read(key)
+	segments := s.snapshot()
+	defer releaseSegments(segments, s.logger)
+	for i := len(segments) - 1; i > -1; i-- {
+		data, err := segments[i].Read(key)
 		if err == nil {
 			return data, nil
 		}
 		if err != index.ErrKeyNotFound {
-			log.Println("Segment read error: ", err)
-			return "", err
+			s.logger.Println("Segment read error: ", err)
+			return nil, err
 		}
 	}
-	return nil, errKeyIsNotInSegments
+	return nil, index.ErrKeyNotFound
 }
 
-func (s *Segments) Merge() {
-	s.Lock()
-	defer s.Unlock()
-	if len(s.segments) < 2 {
-		return
+// FindRowAt looks up the newest row of key with a sequence number of at most
+// seq, from the newest segment to the oldest. The row may be a tombstone.
+func (s *Segments) FindRowAt(key string, seq uint64) (DBRow, error) {
+	segments := s.snapshot()
+	defer releaseSegments(segments, s.logger)
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
 	}
-	s.mergeInProgress = true
-	fmt.Println("Started to Merge")
-	startTime := time.Now()
-	var compactedSegments []Segment
-	for i := range s.segments {
-		if strings.Contains(s.segments[i].GetId(), ".compact") {
-			compactedSegments = append(compactedSegments, s.segments[i])
+	row, err := findRowAt(segments, key, seq)
+	if err != nil && err != index.ErrKeyNotFound {
+		s.logger.Println("Segment read error: ", err)
+	}
+	return row, err
+}
+
+// keptRows returns the versions of key found in sources, ordered by sequence
+// number, that a rewrite has to keep: every version newer than floor, the
+// newest version at or below it and the ones retention keeps.
+func keptRows(sources []Segment, key string, floor uint64, retention Retention, now time.Time) ([]DBRow, error) {
+	rows, err := versionRows(sources, key)
+	if err != nil {
+		return nil, err
+	}
+	keep := 0
+	for i := len(rows) - 1; i > -1; i-- {
+		if rows[i].Seq <= floor {
+			keep = i
+			break
 		}
 	}
+	if retained := retention.keepFrom(rows, now); retained < keep {
+		keep = retained
+	}
+	return rows[keep:], nil
+}
 
-	if len(compactedSegments) < 1 {
-		s.mergeInProgress = false
-		fmt.Printf("Merge done in %f seconds.\n", time.Now().Sub(startTime).Seconds())
+// keptRangeTombstones returns the range tombstones of sources that a rewrite
+// has to keep, ordered by start key and sequence number: the ones newer than
+// floor or retention's Age and the ones that delete a version in one of
+// others.
+func keptRangeTombstones(sources, others []Segment, floor uint64, retention Retention, now time.Time) ([]rangeTombstone, error) {
+	var kept []rangeTombstone
+	for _, seg := range sources {
+		for _, tombstone := range seg.rangeTombstones() {
+			keep := tombstone.record.Seq > floor || retention.keepsSince(tombstone.record.CreationTime, now)
+			for _, other := range others {
+				if keep {
+					break
+				}
+				hasVersion, err := hasVersionBefore(other, tombstone.start, tombstone.end, tombstone.record.Seq)
+				if err != nil {
+					return nil, err
+				}
+				keep = hasVersion
+			}
+			if keep {
+				kept = append(kept, tombstone)
+			}
+		}
 	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		if kept[i].start != kept[j].start {
+			return kept[i].start < kept[j].start
+		}
+		return kept[i].record.Seq < kept[j].record.Seq
+	})
+	return kept, nil
+}
 
-	pmTotalMerge.Inc()
+// segmentBuilder writes the output of a rewrite, either as a log segment or
+// as an SSTable.
+type segmentBuilder interface {
+	add(row DBRow) error
+	size() int64
+	finish() (*immutableSegment, error)
+	abort()
+}
+
+type logSegmentBuilder struct {
+	segment *writableSegment
+}
 
-	newSegment := NewWritableSegment(getFileAbsolutePath(generateDataFileName()), index.NewHashMapIndex())
-	for i := range compactedSegments {
-		keys := compactedSegments[i].GetUniqueKeys()
-		for _, key := range keys {
-			val, readErr := compactedSegments[i].Read(key)
-			if readErr != nil {
-				panic(readErr)
+func (b *logSegmentBuilder) add(row DBRow) error {
+	return b.segment.writeRows([]DBRow{row}, false)
+}
+
+func (b *logSegmentBuilder) size() int64 {
+	return b.segment.size()
+}
+
+func (b *logSegmentBuilder) finish() (*immutableSegment, error) {
+	if err := b.segment.Sync(); err != nil {
+		return nil, err
+	}
+	if err := b.segment.WriteHint(); err != nil {
+		b.segment.logger.Printf("couldn't write hint file of segment %s: %v\n", b.segment.GetId(), err)
+	}
+	return b.segment.getImmutableSegment(), nil
+}
+
+func (b *logSegmentBuilder) abort() {
+	b.segment.Close()
+	if err := os.Remove(b.segment.readFile.Name()); err != nil {
+		b.segment.logger.Printf("couldn't remove %s: %v\n", b.segment.readFile.Name(), err)
+	}
+}
+
+type sstableBuilder struct {
+	writer   *sstableWriter
+	filePath string
+	newIndex func() index.Index
+	logger   *log.Logger
+}
+
+func (b *sstableBuilder) add(row DBRow) error {
+	return b.writer.add(row)
+}
+
+func (b *sstableBuilder) size() int64 {
+	return b.writer.offset
+}
+
+func (b *sstableBuilder) finish() (*immutableSegment, error) {
+	if err := b.writer.finish(); err != nil {
+		return nil, err
+	}
+	seg, err := NewImmutableSegment(b.filePath, b.newIndex(), b.logger)
+	if err != nil {
+		return nil, err
+	}
+	if err = seg.(*immutableSegment).recoverRangeTombstones(); err != nil {
+		seg.Close()
+		return nil, err
+	}
+	return seg.(*immutableSegment), nil
+}
+
+func (b *sstableBuilder) abort() {
+	b.writer.abort()
+}
+
+func (s *Segments) newSegmentBuilder(filePath string, header SegmentHeader) (segmentBuilder, error) {
+	if s.sorted {
+		writer, err := newSSTableWriter(filePath, header)
+		if err != nil {
+			return nil, err
+		}
+		return &sstableBuilder{writer: writer, filePath: filePath, newIndex: s.newIndex, logger: s.logger}, nil
+	}
+	newSegment, err := NewWritableSegment(filePath, header, s.newIndex(), s.logger)
+	if err != nil {
+		return nil, err
+	}
+	return &logSegmentBuilder{segment: newSegment}, nil
+}
+
+// rewrite copies the live versions of sources into new segments, in key
+// order and keeping their sequence numbers and creation times. The first
+// segment is written at filePath and when splitSize isn't zero a new one is
+// started, at a key boundary, every time a segment grows past it. Expired
+// versions lose their value and become tombstones, so they still hide the
+// older versions they replaced. Older versions are kept as far as an open
+// snapshot or the retention needs them. Tombstones and expired versions are
+// dropped entirely once no segment older than the sources has their key.
+// Versions a range tombstone deletes for every snapshot are dropped, and a
+// range tombstone of the sources is kept while another segment still has a
+// version it deletes or a snapshot older than it is open. The new segments
+// are SSTables in LSM mode and they're removed again if anything fails.
+func (s *Segments) rewrite(sources []Segment, filePath string, header SegmentHeader, splitSize int64) ([]Segment, error) {
+	builder, err := s.newSegmentBuilder(filePath, header)
+	if err != nil {
+		return nil, err
+	}
+	var newSegments []Segment
+	floor := uint64(math.MaxUint64)
+	if s.retentionFloor != nil {
+		floor = s.retentionFloor()
+	}
+	frozen := s.snapshot()
+	defer releaseSegments(frozen, s.logger)
+	// the segments the tombstones of the sources may still hide keys in
+	var older, others []Segment
+	for _, seg := range frozen {
+		isSource := false
+		for _, source := range sources {
+			isSource = isSource || seg == source
+		}
+		if isSource {
+			continue
+		}
+		others = append(others, seg)
+		if segmentLess(seg, sources[len(sources)-1]) {
+			older = append(older, seg)
+		}
+	}
+	now := time.Now()
+	reclaimed := 0
+	err = func() error {
+		ranges, err := keptRangeTombstones(sources, others, floor, s.retention, now)
+		if err != nil {
+			return err
+		}
+		// the range tombstones every snapshot sees and retention doesn't keep
+		// the versions they deleted for
+		var deleting []rangeTombstone
+		for _, seg := range frozen {
+			for _, tombstone := range seg.rangeTombstones() {
+				if tombstone.record.Seq <= floor && !s.retention.keepsSince(tombstone.record.CreationTime, now) {
+					deleting = append(deleting, tombstone)
+				}
 			}
-			err := newSegment.Write(key, val)
+		}
+		addRanges := func(upTo string, all bool) error {
+			for len(ranges) > 0 && (all || ranges[0].start <= upTo) {
+				row := DBRow{Key: ranges[0].start, RangeEnd: ranges[0].end, Type: RecordTypeRangeTombstone, Seq: ranges[0].record.Seq, CreationTime: ranges[0].record.CreationTime}
+				if err := builder.add(row); err != nil {
+					return err
+				}
+				ranges = ranges[1:]
+			}
+			return nil
+		}
+		keyLists := make([][]string, len(sources))
+		for i := range sources {
+			if keyLists[i], err = segmentKeysInRange(sources[i], "", ""); err != nil {
+				return err
+			}
+		}
+		for _, key := range mergeSortedKeys(keyLists) {
+			if splitSize > 0 && builder.size() >= splitSize {
+				newSegment, err := builder.finish()
+				if err != nil {
+					return err
+				}
+				newSegments = append(newSegments, newSegment)
+				if builder, err = s.newSegmentBuilder(getFileAbsolutePath(s.dir, generateDataFileName()), header); err != nil {
+					builder = nil
+					return err
+				}
+			}
+			if err = addRanges(key, false); err != nil {
+				return err
+			}
+			rows, err := keptRows(sources, key, floor, s.retention, now)
 			if err != nil {
-				panic(err)
+				return err
+			}
+			// versions deleted by a range tombstone every snapshot sees
+			if deletedAt := newestCovering(deleting, key); deletedAt > 0 {
+				for len(rows) > 0 && rows[0].Seq < deletedAt {
+					rows = rows[1:]
+				}
+			}
+			// nothing older than the leading versions is left to hide
+			leading := !anyHasKey(older, key)
+			for _, row := range rows {
+				expired := row.isExpired(now)
+				if expired {
+					reclaimed++
+				}
+				if leading && (expired || row.isTombstone()) {
+					continue
+				}
+				leading = false
+				copied := DBRow{Key: key, Value: row.Value, Seq: row.Seq, CreationTime: row.CreationTime, ExpiresAt: row.ExpiresAt}
+				if expired || row.isTombstone() {
+					copied = DBRow{Key: key, Type: RecordTypeTombstone, Seq: row.Seq, CreationTime: row.CreationTime}
+				}
+				if err = builder.add(copied); err != nil {
+					return err
+				}
+			}
+		}
+		if err = addRanges("", true); err != nil {
+			return err
+		}
+		newSegment, err := builder.finish()
+		if err != nil {
+			return err
+		}
+		newSegments = append(newSegments, newSegment)
+		builder = nil
+		return nil
+	}()
+	if err != nil {
+		if builder != nil {
+			builder.abort()
+		}
+		for _, seg := range newSegments {
+			seg.Close()
+			if removeErr := removeSegmentFiles(s.dir, seg.GetId()); removeErr != nil {
+				s.logger.Printf("couldn't remove %s: %v\n", seg.GetId(), removeErr)
+			}
+		}
+		return nil, err
+	}
+	pmExpiredReclaims.Add(float64(reclaimed))
+	// the new segments take the place of the newest source
+	var newer []Segment
+	current := s.snapshot()
+	defer releaseSegments(current, s.logger)
+	for _, seg := range current {
+		if segmentLess(sources[len(sources)-1], seg) {
+			newer = append(newer, seg)
+		}
+	}
+	for _, seg := range newSegments {
+		seg.(*immutableSegment).buildFilter()
+		if err = s.initUsage(seg.(*immutableSegment), older, newer); err != nil {
+			s.logger.Printf("couldn't count the garbage of segment %s: %v\n", seg.GetId(), err)
+		}
+	}
+	return newSegments, nil
+}
+
+// register records seg, a new current segment, as live in the manifest
+// before anything is written to it.
+func (s *Segments) register(seg Segment) error {
+	if s.manifest == nil {
+		return nil
+	}
+	if err := s.manifest.apply(manifestEdit{added: []string{seg.GetId()}}); err != nil {
+		return fmt.Errorf("couldn't add segment %s to the manifest: %w", seg.GetId(), err)
+	}
+	return nil
+}
+
+// replace swaps removed for added with a single manifest edit, so a crash
+// leaves either of them live and the other one's files to be removed as
+// orphans. The new segments are removed again if the edit fails.
+func (s *Segments) replace(added, removed []Segment) error {
+	if s.manifest != nil {
+		var edit manifestEdit
+		for _, seg := range added {
+			edit.added = append(edit.added, seg.GetId())
+		}
+		for _, seg := range removed {
+			edit.removed = append(edit.removed, seg.GetId())
+			// the sequence numbers of the versions the rewrite dropped
+			// must not be handed out again
+			if seg.MaxSeq() > edit.lastSeq {
+				edit.lastSeq = seg.MaxSeq()
 			}
 		}
+		if err := s.manifest.apply(edit); err != nil {
+			for _, seg := range added {
+				seg.Close()
+				if removeErr := removeSegmentFiles(s.dir, seg.GetId()); removeErr != nil {
+					s.logger.Printf("couldn't remove %s: %v\n", seg.GetId(), removeErr)
+				}
+			}
+			return fmt.Errorf("couldn't record the replacement of %d segments in the manifest: %w", len(removed), err)
+		}
+	}
+	for _, seg := range added {
+		s.Add(seg)
 	}
-	s.Add(newSegment.getImmutableSegment())
-	for i := range compactedSegments {
-		err := s.Delete(compactedSegments[i].GetId())
+	for _, seg := range removed {
+		if err := s.remove(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Segments) remove(seg Segment) error {
+	if err := s.Delete(seg.GetId()); err != nil {
+		return err
+	}
+	if immutable, ok := seg.(*immutableSegment); ok {
+		immutable.usage.release()
+	}
+	// the files are closed once the snapshots reading them are released,
+	// until then they keep the unlinked data
+	if err := seg.Close(); err != nil {
+		s.logger.Printf("couldn't close segment %s: %v\n", seg.GetId(), err)
+	}
+	return removeSegmentFiles(s.dir, seg.GetId())
+}
+
+// claimMerge reserves the next background merge, it returns false when one
+// is already claimed and hasn't finished yet. The caller runs it with
+// runClaimedMerge.
+func (s *Segments) claimMerge() bool {
+	return atomic.CompareAndSwapInt32(&s.mergeInProgress, 0, 1)
+}
+
+// runClaimedMerge runs the merge claimMerge reserved, the next one can be
+// claimed once it's done.
+func (s *Segments) runClaimedMerge() error {
+	defer atomic.StoreInt32(&s.mergeInProgress, 0)
+	return s.Merge()
+}
+
+// Merge runs the merges planned by the compaction strategy, planning again
+// after every round until the strategy has nothing left to do or a round
+// doesn't get anywhere.
+func (s *Segments) Merge() error {
+	s.Lock()
+	defer s.Unlock()
+	s.logger.Println("Started to Merge")
+	startTime := time.Now()
+	for {
+		progressed, err := s.mergeRound()
 		if err != nil {
-			panic(err)
+			return err
+		}
+		if !progressed {
+			break
 		}
-		removeErr := os.Remove(getFileAbsolutePath(compactedSegments[i].GetId()))
-		if removeErr != nil {
-			panic(removeErr)
+	}
+	s.logger.Printf("Merge done in %f seconds.\n", time.Now().Sub(startTime).Seconds())
+	return nil
+}
+
+// mergeRound runs the merges the compaction strategy plans for the current
+// segments and reports whether one of them progressed, see
+// runCompactionTask. A rewrite that can't drop the versions an open
+// snapshot or the retention still needs is planned again by the next merge.
+func (s *Segments) mergeRound() (bool, error) {
+	segments := s.snapshot()
+	defer releaseSegments(segments, s.logger)
+	infos := make([]SegmentInfo, len(segments))
+	for i, seg := range segments {
+		infos[i] = segmentInfo(seg)
+	}
+	progressed := false
+	for _, task := range s.strategy.Plan(infos) {
+		taskProgressed, err := s.runCompactionTask(segments, task)
+		if err != nil {
+			return false, err
 		}
+		progressed = progressed || taskProgressed
+	}
+	return progressed, nil
+}
+
+// runCompactionTask merges the inputs of task into segments at the task's
+// output level, which replace the inputs. It reports whether the merge
+// progressed: it moved a segment to another level, left fewer segments or
+// fewer bytes.
+func (s *Segments) runCompactionTask(segments []Segment, task CompactionTask) (bool, error) {
+	byId := map[string]Segment{}
+	for _, seg := range segments {
+		byId[seg.GetId()] = seg
+	}
+	var inputs []Segment
+	header := SegmentHeader{IsCompacted: true, Level: uint8(task.OutputLevel)}
+	progressed := false
+	var inputSize int64
+	for _, info := range task.Inputs {
+		seg, ok := byId[info.Id]
+		if !ok || task.OutputLevel > MaxSegmentLevel {
+			return false, fmt.Errorf("compaction strategy planned an invalid merge of segment %s to level %d", info.Id, task.OutputLevel)
+		}
+		inputs = append(inputs, seg)
+		progressed = progressed || int(seg.GetHeader().Level) != task.OutputLevel
+		if stat, err := seg.GetFileInfo(); err == nil {
+			inputSize += stat.Size()
+		}
+		if seg.GetHeader().Sequence > header.Sequence {
+			header.Sequence = seg.GetHeader().Sequence
+		}
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		return segmentLess(inputs[i], inputs[j])
+	})
+	pmTotalMerge.Inc()
+	newSegments, err := s.rewrite(inputs, getFileAbsolutePath(s.dir, generateDataFileName()), header, task.SplitSize)
+	if err != nil {
+		return false, fmt.Errorf("couldn't merge segments: %w", err)
+	}
+	var outputSize int64
+	for _, seg := range newSegments {
+		if stat, err := seg.GetFileInfo(); err == nil {
+			outputSize += stat.Size()
+		}
+	}
+	if err = s.replace(newSegments, inputs); err != nil {
+		return false, err
 	}
-	s.mergeInProgress = false
-	fmt.Printf("Merge done in %f seconds.\n", time.Now().Sub(startTime).Seconds())
+	s.logger.Printf("Merged %d segments into %d at level %d\n", len(inputs), len(newSegments), task.OutputLevel)
+	return progressed || len(newSegments) < len(inputs) || outputSize < inputSize, nil
 }
 
-func (s *Segments) Compaction() {
+// Compaction rewrites the segments that aren't compacted yet and have at
+// least garbageThreshold of garbage, keeping only the latest value of each
+// key. The other ones are left for the compaction strategy to merge. In LSM
+// mode every segment that isn't compacted is flushed to an SSTable.
+func (s *Segments) Compaction() error {
 	s.Lock()
 	defer s.Unlock()
-	fmt.Println("Started to Compaction")
+	s.logger.Println("Started to Compaction")
 	startTime := time.Now()
-	s.compactionInProgress = true
+	atomic.StoreInt32(&s.compactionInProgress, 1)
+	defer atomic.StoreInt32(&s.compactionInProgress, 0)
 
 	var segmentsThatNeedCompaction []Segment
-	for i := range s.segments {
-		if !strings.Contains(s.segments[i].GetId(), ".compact") {
-			segmentsThatNeedCompaction = append(segmentsThatNeedCompaction, s.segments[i])
+	now := time.Now()
+	segments := s.snapshot()
+	defer releaseSegments(segments, s.logger)
+	for _, seg := range segments {
+		if seg.GetHeader().IsCompacted {
+			continue
+		}
+		if immutable, ok := seg.(*immutableSegment); ok && !s.sorted &&
+			immutable.usageStats(now).ReclaimableRatio() < s.garbageThreshold {
+			continue
 		}
+		segmentsThatNeedCompaction = append(segmentsThatNeedCompaction, seg)
 	}
 
 	if len(segmentsThatNeedCompaction) < 1 {
-		s.compactionInProgress = false
-		fmt.Printf("Compaction done in %f seconds.\n", time.Now().Sub(startTime).Seconds())
+		s.logger.Printf("Compaction done in %f seconds.\n", time.Now().Sub(startTime).Seconds())
+		return nil
 	}
 	pmTotalCompaction.Inc()
 
 	var wg sync.WaitGroup
-	for _, seg := range segmentsThatNeedCompaction {
+	errs := make([]error, len(segmentsThatNeedCompaction))
+	for i, seg := range segmentsThatNeedCompaction {
 		wg.Add(1)
-		go func(safeSegment Segment) {
-			newSegment := NewWritableSegment(getFileAbsolutePath(safeSegment.GetId()+".compact"), safeSegment.GetIndexStrategy())
-			for _, key := range newSegment.GetUniqueKeys() {
-				val, readErr := safeSegment.Read(key)
-				if readErr != nil {
-					panic(readErr)
-				}
-				writeErr := newSegment.Write(key, val)
-				if writeErr != nil {
-					panic(writeErr)
-				}
-			}
-			deleteErr := s.Delete(safeSegment.GetId())
-			if deleteErr != nil {
-				panic(deleteErr)
-			}
-			removeErr := os.Remove(getFileAbsolutePath(safeSegment.GetId()))
-			if removeErr != nil {
-				panic(removeErr)
-			}
-			s.Add(newSegment.getImmutableSegment())
-			wg.Done()
-		}(seg)
+		go func(i int, safeSegment Segment) {
+			defer wg.Done()
+			errs[i] = s.compactSegment(safeSegment)
+		}(i, seg)
 	}
 	wg.Wait()
+	s.logger.Printf("Compaction done in %f seconds.\n", time.Now().Sub(startTime).Seconds())
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func NewSegments() *Segments {
-	return &Segments{segments: []Segment{}}
+// compactSegment rewrites seg keeping only the versions that are still
+// needed and replaces seg with the result.
+func (s *Segments) compactSegment(seg Segment) error {
+	compactedHeader := SegmentHeader{IsCompacted: true, Sequence: seg.GetHeader().Sequence, Level: seg.GetHeader().Level}
+	newSegments, err := s.rewrite([]Segment{seg}, getFileAbsolutePath(s.dir, seg.GetId()+".compact"), compactedHeader, 0)
+	if err != nil {
+		return fmt.Errorf("couldn't compact segment %s: %w", seg.GetId(), err)
+	}
+	return s.replace(newSegments, []Segment{seg})
+}
+
+// Flush compacts a segment that was just frozen right away, which in LSM
+// mode turns the memtable into an SSTable. A segment that was compacted in
+// the meantime is left alone.
+func (s *Segments) Flush(seg Segment) error {
+	s.Lock()
+	defer s.Unlock()
+	segments := s.snapshot()
+	defer releaseSegments(segments, s.logger)
+	for _, current := range segments {
+		if current == seg {
+			pmTotalCompaction.Inc()
+			return s.compactSegment(seg)
+		}
+	}
+	return nil
+}
+
+func NewSegments(dir string, opts Options) *Segments {
+	return &Segments{
+		dir:      dir,
+		newIndex: opts.IndexFactory,
+		logger:   opts.Logger,
+		sorted:   opts.Storage == LSMStorage,
+		strategy: opts.CompactionStrategy,
+		segments: []Segment{},
+
+		garbageThreshold: opts.GarbageThreshold,
+		retention:        opts.Retention,
+	}
 }
@@ -0,0 +1,515 @@
+package databaseexperiment
+
+import (
+	"bufio"
+	"bytes"
+	"database-experiment/index"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// An SSTable is a segment whose records are sorted by key, and by sequence
+// number within a key, followed by an index of them:
+//
+//	| segment header | records... | key blocks... | block index | footer |
+//
+// The records are framed like in any other segment. A key block lists the
+// records of a run of keys, every key stored as the length of the prefix it
+// shares with the previous key of the block followed by the rest of it:
+//
+//	| shared (uvarint) | unshared (uvarint) | unshared key bytes | offset (uvarint) | size (uvarint) | creation time (varint) | seq (uvarint) | flags (uvarint) | expires at (varint) | ... | crc32 (4) |
+//
+// with the same flags as hint files. A range tombstone is listed under its
+// start key, before the versions of that key. The versions of a key are never
+// split between blocks. The block index
+// holds the first key, the offset and the length of every key block:
+//
+//	| key length (uvarint) | key | offset (uvarint) | length (uvarint) | ...
+//
+// and the fixed size footer locates it:
+//
+//	| block index offset (8) | block index length (8) | max seq (8) | crc32 of block index (4) |
+//
+// Only the block index is kept in memory, a lookup binary searches it and
+// reads a single key block.
+const (
+	sstableBlockSize  = 4096
+	sstableFooterSize = 8 + 8 + 8 + 4
+)
+
+var (
+	errSSTableOutOfOrder = errors.New("sstable rows must be added in key and sequence order")
+)
+
+type sstableBlockHandle struct {
+	firstKey string
+	offset   int64
+	length   int64
+}
+
+// sstableWriter writes an SSTable from rows added in order.
+type sstableWriter struct {
+	file    *os.File
+	w       *bufio.Writer
+	offset  int64
+	maxSeq  uint64
+	rows    int
+	prevKey string
+	prevSeq uint64
+	// prevRange is set when the previous row was a range tombstone
+	prevRange bool
+
+	// key blocks are kept in memory until all the records are written
+	blocks      []byte
+	blockIndex  []sstableBlockHandle
+	block       []byte
+	blockLength int
+}
+
+func newSSTableWriter(filePath string, header SegmentHeader) (*sstableWriter, error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fs.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	header.Version = sstableSegmentVersion
+	w := bufio.NewWriterSize(file, 1<<20)
+	if _, err = w.Write(header.encode()); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+	return &sstableWriter{file: file, w: w, offset: headerLength}, nil
+}
+
+// add appends row, the rows of a table have to be added sorted by key and
+// the versions of a key from the oldest to the newest. Range tombstones are
+// added by their start key, before the versions of it.
+func (sw *sstableWriter) add(row DBRow) error {
+	isRange := row.Type == RecordTypeRangeTombstone
+	if sw.rows > 0 && row.Key <= sw.prevKey {
+		outOfOrder := true
+		if row.Key == sw.prevKey && isRange == sw.prevRange {
+			outOfOrder = row.Seq < sw.prevSeq
+		} else if row.Key == sw.prevKey {
+			outOfOrder = isRange
+		}
+		if outOfOrder {
+			return errSSTableOutOfOrder
+		}
+	}
+	if row.CreationTime == 0 {
+		row.CreationTime = time.Now().Unix()
+	}
+	row.Offset = formatOffset(sw.offset)
+	record, err := encodeRecord(&row)
+	if err != nil {
+		return err
+	}
+	if _, err = sw.w.Write(record); err != nil {
+		return err
+	}
+
+	if len(sw.block) >= sstableBlockSize && row.Key != sw.prevKey {
+		sw.finishBlock()
+	}
+	shared := 0
+	if len(sw.block) == 0 {
+		sw.blockIndex = append(sw.blockIndex, sstableBlockHandle{firstKey: row.Key, offset: int64(len(sw.blocks))})
+	} else {
+		for shared < len(row.Key) && shared < len(sw.prevKey) && row.Key[shared] == sw.prevKey[shared] {
+			shared++
+		}
+	}
+	varint := make([]byte, binary.MaxVarintLen64)
+	sw.block = append(sw.block, varint[:binary.PutUvarint(varint, uint64(shared))]...)
+	sw.block = append(sw.block, varint[:binary.PutUvarint(varint, uint64(len(row.Key)-shared))]...)
+	sw.block = append(sw.block, row.Key[shared:]...)
+	sw.block = append(sw.block, varint[:binary.PutUvarint(varint, uint64(sw.offset))]...)
+	sw.block = append(sw.block, varint[:binary.PutUvarint(varint, uint64(len(record)))]...)
+	sw.block = append(sw.block, varint[:binary.PutVarint(varint, row.CreationTime)]...)
+	sw.block = append(sw.block, varint[:binary.PutUvarint(varint, row.Seq)]...)
+	flags := recordFlags(index.Record{Tombstone: row.isTombstone()})
+	if isRange {
+		flags = recordFlagRangeTombstone
+	}
+	sw.block = append(sw.block, varint[:binary.PutUvarint(varint, flags)]...)
+	sw.block = append(sw.block, varint[:binary.PutVarint(varint, row.ExpiresAt)]...)
+
+	sw.offset += int64(len(record))
+	if row.Seq > sw.maxSeq {
+		sw.maxSeq = row.Seq
+	}
+	sw.prevKey, sw.prevSeq, sw.prevRange = row.Key, row.Seq, isRange
+	sw.rows++
+	return nil
+}
+
+func (sw *sstableWriter) finishBlock() {
+	if len(sw.block) == 0 {
+		return
+	}
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.Checksum(sw.block, crcTable))
+	sw.block = append(sw.block, sum...)
+	sw.blockIndex[len(sw.blockIndex)-1].length = int64(len(sw.block))
+	sw.blocks = append(sw.blocks, sw.block...)
+	sw.block = sw.block[:0]
+}
+
+// finish writes the key blocks, the block index and the footer, syncs the
+// table and closes it.
+func (sw *sstableWriter) finish() error {
+	sw.finishBlock()
+	blocksOffset := sw.offset
+	if _, err := sw.w.Write(sw.blocks); err != nil {
+		return err
+	}
+
+	var blockIndex []byte
+	varint := make([]byte, binary.MaxVarintLen64)
+	for _, handle := range sw.blockIndex {
+		blockIndex = append(blockIndex, varint[:binary.PutUvarint(varint, uint64(len(handle.firstKey)))]...)
+		blockIndex = append(blockIndex, handle.firstKey...)
+		blockIndex = append(blockIndex, varint[:binary.PutUvarint(varint, uint64(blocksOffset+handle.offset))]...)
+		blockIndex = append(blockIndex, varint[:binary.PutUvarint(varint, uint64(handle.length))]...)
+	}
+	footer := make([]byte, sstableFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(blocksOffset+int64(len(sw.blocks))))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(blockIndex)))
+	binary.LittleEndian.PutUint64(footer[16:], sw.maxSeq)
+	binary.LittleEndian.PutUint32(footer[24:], crc32.Checksum(blockIndex, crcTable))
+	if _, err := sw.w.Write(blockIndex); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(footer); err != nil {
+		return err
+	}
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	if err := sw.file.Sync(); err != nil {
+		return err
+	}
+	return sw.file.Close()
+}
+
+// abort closes and removes the partially written table.
+func (sw *sstableWriter) abort() {
+	sw.file.Close()
+	os.Remove(sw.file.Name())
+}
+
+// sstableIndex is the index.OrderedIndex of an SSTable. It reads the key
+// blocks from the table on every lookup and can't be modified.
+type sstableIndex struct {
+	file      io.ReaderAt
+	segmentId string
+	blocks    []sstableBlockHandle
+	maxSeq    uint64
+	// dataEnd is the offset the records end at
+	dataEnd int64
+	logger  *log.Logger
+}
+
+type sstableEntry struct {
+	key            string
+	record         index.Record
+	rangeTombstone bool
+}
+
+func openSSTableIndex(file io.ReaderAt, segmentId string, size int64, logger *log.Logger) (*sstableIndex, error) {
+	corrupt := func(reason string) error {
+		return &ErrCorruptRecord{SegmentId: segmentId, Offset: size - sstableFooterSize, Reason: reason}
+	}
+	if size < headerLength+sstableFooterSize {
+		return nil, corrupt("sstable is too short for a footer")
+	}
+	footer := make([]byte, sstableFooterSize)
+	if _, err := file.ReadAt(footer, size-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	indexLength := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if indexOffset < headerLength || indexLength < 0 || indexOffset+indexLength != size-sstableFooterSize {
+		return nil, corrupt("sstable footer points outside of the table")
+	}
+	blockIndex := make([]byte, indexLength)
+	if _, err := file.ReadAt(blockIndex, indexOffset); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(blockIndex, crcTable) != binary.LittleEndian.Uint32(footer[24:]) {
+		return nil, corrupt("sstable block index checksum mismatch")
+	}
+
+	t := &sstableIndex{
+		file:      file,
+		segmentId: segmentId,
+		maxSeq:    binary.LittleEndian.Uint64(footer[16:]),
+		logger:    logger,
+	}
+	r := bytes.NewReader(blockIndex)
+	for r.Len() > 0 {
+		keyLen, err := binary.ReadUvarint(r)
+		if err != nil || keyLen > uint64(r.Len()) {
+			return nil, corrupt("sstable block index is truncated")
+		}
+		key := make([]byte, keyLen)
+		r.Read(key)
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, corrupt("sstable block index is truncated")
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length < 4 || int64(offset+length) > indexOffset {
+			return nil, corrupt("sstable block index is truncated")
+		}
+		t.blocks = append(t.blocks, sstableBlockHandle{firstKey: string(key), offset: int64(offset), length: int64(length)})
+	}
+	t.dataEnd = indexOffset
+	if len(t.blocks) > 0 {
+		t.dataEnd = t.blocks[0].offset
+	}
+	return t, nil
+}
+
+// findBlock returns the only block that can hold key, or -1.
+func (t *sstableIndex) findBlock(key string) int {
+	return sort.Search(len(t.blocks), func(i int) bool {
+		return t.blocks[i].firstKey > key
+	}) - 1
+}
+
+func (t *sstableIndex) readBlock(i int) ([]sstableEntry, error) {
+	handle := t.blocks[i]
+	data := make([]byte, handle.length)
+	if _, err := t.file.ReadAt(data, handle.offset); err != nil {
+		return nil, err
+	}
+	corrupt := func(reason string) error {
+		return &ErrCorruptRecord{SegmentId: t.segmentId, Offset: handle.offset, Reason: reason}
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(sum) {
+		return nil, corrupt("sstable key block checksum mismatch")
+	}
+
+	var entries []sstableEntry
+	var prevKey []byte
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		shared, err := binary.ReadUvarint(r)
+		if err != nil || shared > uint64(len(prevKey)) {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		unshared, err := binary.ReadUvarint(r)
+		if err != nil || unshared > uint64(r.Len()) {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		key := make([]byte, shared+unshared)
+		copy(key, prevKey[:shared])
+		r.Read(key[shared:])
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		creationTime, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		seq, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		flags, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		expiresAt, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, corrupt("sstable key block is malformed")
+		}
+		entries = append(entries, sstableEntry{
+			key: string(key),
+			record: index.Record{
+				Offset:       formatOffset(int64(offset)),
+				Size:         int64(size),
+				CreationTime: creationTime,
+				Seq:          seq,
+				Tombstone:    flags&recordFlagTombstone != 0,
+				ExpiresAt:    expiresAt,
+			},
+			rangeTombstone: flags&recordFlagRangeTombstone != 0,
+		})
+		prevKey = key
+	}
+	return entries, nil
+}
+
+func (t *sstableIndex) GetVersions(key string) ([]index.Record, error) {
+	i := t.findBlock(key)
+	if i < 0 {
+		return nil, index.ErrKeyNotFound
+	}
+	entries, err := t.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	var versions []index.Record
+	for _, entry := range entries {
+		if entry.key == key && !entry.rangeTombstone {
+			versions = append(versions, entry.record)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, index.ErrKeyNotFound
+	}
+	return versions, nil
+}
+
+func (t *sstableIndex) GetRecordAt(key string, seq uint64) (index.Record, error) {
+	versions, err := t.GetVersions(key)
+	if err != nil {
+		return index.Record{}, err
+	}
+	for i := len(versions) - 1; i > -1; i-- {
+		if versions[i].Seq <= seq {
+			return versions[i], nil
+		}
+	}
+	return index.Record{}, index.ErrKeyNotFound
+}
+
+func (t *sstableIndex) GetRecord(key string) (index.Record, error) {
+	versions, err := t.GetVersions(key)
+	if err != nil {
+		return index.Record{}, err
+	}
+	return versions[len(versions)-1], nil
+}
+
+func (t *sstableIndex) Get(key string) (string, error) {
+	record, err := t.GetRecord(key)
+	if err != nil {
+		return "", err
+	}
+	return record.Offset, nil
+}
+
+func (t *sstableIndex) GetCreationTime(key string) (int64, error) {
+	record, err := t.GetRecord(key)
+	if err != nil {
+		return 0, err
+	}
+	return record.CreationTime, nil
+}
+
+// keysInRange returns the keys in [start, end), an empty end means there is
+// no upper bound.
+func (t *sstableIndex) keysInRange(start, end string) ([]string, error) {
+	var keys []string
+	first := t.findBlock(start)
+	if first < 0 {
+		first = 0
+	}
+	for i := first; i < len(t.blocks); i++ {
+		if end != "" && t.blocks[i].firstKey >= end {
+			break
+		}
+		entries, err := t.readBlock(i)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.rangeTombstone || entry.key < start || end != "" && entry.key >= end {
+				continue
+			}
+			if len(keys) == 0 || keys[len(keys)-1] != entry.key {
+				keys = append(keys, entry.key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// forEachKey calls fn with the versions of every key in order, reading every
+// key block once.
+func (t *sstableIndex) forEachKey(fn func(key string, versions []index.Record)) error {
+	for i := range t.blocks {
+		blockEntries, err := t.readBlock(i)
+		if err != nil {
+			return err
+		}
+		entries := blockEntries[:0]
+		for _, entry := range blockEntries {
+			if !entry.rangeTombstone {
+				entries = append(entries, entry)
+			}
+		}
+		for start := 0; start < len(entries); {
+			end := start + 1
+			for end < len(entries) && entries[end].key == entries[start].key {
+				end++
+			}
+			versions := make([]index.Record, 0, end-start)
+			for _, entry := range entries[start:end] {
+				versions = append(versions, entry.record)
+			}
+			fn(entries[start].key, versions)
+			start = end
+		}
+	}
+	return nil
+}
+
+// rangeTombstones returns the entries of the range tombstones of the table,
+// reading every key block once.
+func (t *sstableIndex) rangeTombstones() ([]sstableEntry, error) {
+	var tombstones []sstableEntry
+	for i := range t.blocks {
+		entries, err := t.readBlock(i)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.rangeTombstone {
+				tombstones = append(tombstones, entry)
+			}
+		}
+	}
+	return tombstones, nil
+}
+
+func (t *sstableIndex) KeysInRange(start, end string) []string {
+	keys, err := t.keysInRange(start, end)
+	if err != nil {
+		t.logger.Printf("couldn't list keys of sstable %s: %v\n", t.segmentId, err)
+	}
+	return keys
+}
+
+func (t *sstableIndex) AllKeys() []string {
+	return t.KeysInRange("", "")
+}
+
+func (t *sstableIndex) Set(key string, _ index.Record) {
+	panic(fmt.Sprintf("sstable %s is immutable, can't set key %s", t.segmentId, strconv.Quote(key)))
+}
+
+func (t *sstableIndex) Delete(key string) {
+	panic(fmt.Sprintf("sstable %s is immutable, can't delete key %s", t.segmentId, strconv.Quote(key)))
+}
+
+func (t *sstableIndex) CollectPromMetrics() {}
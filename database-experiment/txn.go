@@ -0,0 +1,156 @@
+package databaseexperiment
+
+import (
+	"database-experiment/index"
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+var (
+	// ErrConflict is returned by Commit when a key the transaction read was
+	// changed by another writer after the transaction began.
+	ErrConflict = errors.New("transaction conflicts with a concurrent write")
+	ErrTxnDone  = errors.New("transaction has already been committed or rolled back")
+)
+
+// Txn is a snapshot-isolated transaction. Reads see the database as it was
+// when Begin was called plus the transaction's own writes, which are buffered
+// until Commit. A Txn must not be used from multiple goroutines at once.
+type Txn struct {
+	db       *Database
+	snapshot uint64
+	reads    map[string]struct{}
+	writes   map[string]int // key to its row in batch
+	batch    WriteBatch
+	done     bool
+}
+
+// Begin starts a transaction reading at the newest committed write.
+func (db *Database) Begin() *Txn {
+	return &Txn{
+		db:       db,
+		snapshot: db.acquireSnapshot(),
+		reads:    map[string]struct{}{},
+		writes:   map[string]int{},
+	}
+}
+
+// acquireSnapshot returns the sequence number of the newest committed write
+// and keeps compaction from dropping the versions visible at it until
+// releaseSnapshot is called.
+func (db *Database) acquireSnapshot() uint64 {
+	db.snapshotsLock.Lock()
+	defer db.snapshotsLock.Unlock()
+	snapshot := atomic.LoadUint64(&db.lastSeq)
+	db.snapshots[snapshot]++
+	return snapshot
+}
+
+// oldestSnapshot returns the sequence number of the oldest open transaction,
+// or math.MaxUint64 when there is none.
+func (db *Database) oldestSnapshot() uint64 {
+	db.snapshotsLock.Lock()
+	defer db.snapshotsLock.Unlock()
+	oldest := uint64(math.MaxUint64)
+	for seq := range db.snapshots {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+	return oldest
+}
+
+func (db *Database) releaseSnapshot(seq uint64) {
+	db.snapshotsLock.Lock()
+	defer db.snapshotsLock.Unlock()
+	if db.snapshots[seq]--; db.snapshots[seq] == 0 {
+		delete(db.snapshots, seq)
+	}
+}
+
+func (t *Txn) Get(key string) (interface{}, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if i, ok := t.writes[key]; ok {
+		if t.batch.rows[i].isTombstone() {
+			return nil, index.ErrKeyNotFound
+		}
+		return t.batch.rows[i].Value, nil
+	}
+	t.reads[key] = struct{}{}
+	pmTotalReads.Inc()
+	return t.db.getAt(key, t.snapshot)
+}
+
+func (t *Txn) Set(key string, value interface{}) error {
+	return t.write(DBRow{Key: key, Value: value})
+}
+
+func (t *Txn) Delete(key string) error {
+	return t.write(DBRow{Key: key, Type: RecordTypeTombstone})
+}
+
+// write buffers row, replacing an earlier write of the same key.
+func (t *Txn) write(row DBRow) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if i, ok := t.writes[row.Key]; ok {
+		t.batch.rows[i] = row
+		return nil
+	}
+	t.writes[row.Key] = t.batch.Len()
+	t.batch.rows = append(t.batch.rows, row)
+	return nil
+}
+
+// Commit writes the transaction atomically. It returns ErrConflict and
+// writes nothing when a key the transaction read has been written since the
+// transaction began. Keys that were only written never conflict.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.finish()
+	if t.batch.Len() == 0 {
+		return nil
+	}
+	db := t.db
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+	for key := range t.reads {
+		row, err := db.lookup(key, math.MaxUint64)
+		if err == index.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if row.Seq > t.snapshot {
+			pmTotalConflicts.Inc()
+			return ErrConflict
+		}
+	}
+	pmTotalWrites.Add(float64(t.batch.Len()))
+	if err := db.appendRows(t.batch.rows, true); err != nil {
+		db.opts.Logger.Printf("couldn't commit transaction of %d operations err is: %v\n", t.batch.Len(), err)
+		return err
+	}
+	db.checkCurrentSegmentSizeInBackground()
+	return nil
+}
+
+// Rollback discards the writes of the transaction. It's safe to call after
+// Commit, which makes it convenient to defer.
+func (t *Txn) Rollback() {
+	if !t.done {
+		t.finish()
+	}
+}
+
+func (t *Txn) finish() {
+	t.done = true
+	t.db.releaseSnapshot(t.snapshot)
+}